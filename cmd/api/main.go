@@ -5,7 +5,9 @@ import (
 	"os"
 
 	"github.com/Utsav7428/ChronoXchange/internal/api"
+	"github.com/Utsav7428/ChronoXchange/internal/bus"
 	"github.com/Utsav7428/ChronoXchange/internal/database"
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
 
 	"github.com/gin-gonic/gin"
 )
@@ -17,6 +19,22 @@ func main() {
 	// Connect to the database
 	database.Connect()
 
+	// Load market rules so invalid orders are rejected before reaching the engine
+	registry, err := markets.LoadFromEnv()
+	if err != nil {
+		slog.Error("could not load market registry", "error", err)
+		os.Exit(1)
+	}
+	api.SetMarkets(registry)
+
+	// Connect to the message bus the engine reads commands from
+	messages, err := bus.DialRedis(os.Getenv("REDIS_URL"))
+	if err != nil {
+		slog.Error("could not parse redis url", "error", err)
+		os.Exit(1)
+	}
+	api.SetBus(messages)
+
 	// Set up the web server
 	router := gin.Default()
 
@@ -28,10 +46,26 @@ func main() {
 			auth.POST("/signup", api.Signup)
 			auth.POST("/login", api.Login)
 		}
+		v1.GET("/depth", api.GetDepth)
+
 		orders := v1.Group("/orders")
 		orders.Use(api.AuthMiddleware())
 		{
 			orders.POST("", api.CreateOrder)
+			orders.PATCH("/:id", api.AmendOrder)
+			orders.DELETE("/:id", api.CancelOrder)
+		}
+
+		account := v1.Group("/account")
+		account.Use(api.AuthMiddleware())
+		{
+			account.GET("/balances", api.GetBalances)
+			account.GET("/fees", api.GetFees)
+			// Crediting balances stands in for real deposits, so it is only
+			// served when explicitly enabled for development.
+			if os.Getenv("ENABLE_ONRAMP") == "true" {
+				account.POST("/onramp", api.OnRamp)
+			}
 		}
 	}
 
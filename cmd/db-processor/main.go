@@ -3,17 +3,31 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"time"
 
+	"github.com/Utsav7428/ChronoXchange/internal/bus"
 	"github.com/Utsav7428/ChronoXchange/internal/database"
 	"github.com/Utsav7428/ChronoXchange/pkg/types"
 
-	"github.com/redis/go-redis/v9"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-const dbProcessorQueue = "db_processor"
+const (
+	// dbProcessorQueue carries engine output, read through the dbProcessorGroup consumer group.
+	dbProcessorQueue = "db_events"
+	dbProcessorGroup = "db-processor"
+
+	// Messages left pending longer than reclaimIdle, by a consumer that died
+	// or by a write that failed here, are taken back every reclaimInterval.
+	reclaimIdle     = time.Minute
+	reclaimInterval = time.Minute
+)
 
 func main() {
 	// 1. Initialize Logger
@@ -24,98 +38,241 @@ func main() {
 	// This uses the Connect function and models we created earlier.
 	database.Connect()
 
-	// 3. Connect to Redis
+	// 3. Connect to the message bus
 	redisURL := os.Getenv("REDIS_URL")
 	if redisURL == "" {
 		slog.Error("REDIS_URL not set, using default")
 		redisURL = "redis://localhost:6379/0"
 	}
-	opts, err := redis.ParseURL(redisURL)
+	messages, err := bus.DialRedis(redisURL)
 	if err != nil {
 		slog.Error("could not parse redis url", "error", err)
 		os.Exit(1)
 	}
-	redisClient := redis.NewClient(opts)
 	ctx := context.Background()
 
-	slog.Info("DB processor started, waiting for messages...")
+	// 4. Join the consumer group. The name must stay the same across restarts
+	// so that messages this process took but never acked come back to it.
+	name := os.Getenv("DB_PROCESSOR_CONSUMER")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	consumer, err := messages.Consume(ctx, dbProcessorQueue, dbProcessorGroup, name)
+	if err != nil {
+		slog.Error("could not join consumer group", "error", err)
+		os.Exit(1)
+	}
+
+	slog.Info("DB processor started, waiting for messages...", "consumer", name)
 
-	// 4. Main Loop: Listen for and process messages indefinitely
+	// 5. Main Loop: first whatever this consumer left pending, then new messages,
+	// taking back stale pending messages now and then.
+	lastReclaim := time.Time{}
 	for {
-		// Perform a blocking pop from the Redis list.
-		// It waits for 0 seconds (forever) until a message is available.
-		result, err := redisClient.BRPop(ctx, 0, dbProcessorQueue).Result()
+		if time.Since(lastReclaim) >= reclaimInterval {
+			if n, err := consumer.Reclaim(ctx, reclaimIdle); err != nil {
+				slog.Error("could not reclaim pending messages", "error", err)
+			} else if n > 0 {
+				slog.Info("reclaimed pending messages", "count", n)
+			}
+			lastReclaim = time.Now()
+		}
+
+		msg, err := consumer.Receive(ctx, 5*time.Second)
+		if errors.Is(err, bus.ErrNoMessage) {
+			continue
+		}
 		if err != nil {
-			slog.Error("error popping from redis queue", "error", err)
+			slog.Error("error reading from db events queue", "error", err)
 			time.Sleep(1 * time.Second) // Avoid spamming logs on persistent error
 			continue
 		}
+		process(ctx, consumer, msg)
+	}
+}
 
-		// result is a slice where result[0] is the queue name and result[1] is the message.
-		messageData := []byte(result[1])
-		slog.Info("received message from queue", "data", string(messageData))
+// process handles one message and acks it once it is written. A message whose
+// write failed stays pending and is retried when it is reclaimed; every handler
+// is idempotent, so a message processed twice changes nothing the second time.
+func process(ctx context.Context, consumer bus.Consumer, msg bus.Message) {
+	if err := handleMessage(msg.Data); err != nil {
+		slog.Error("could not process message, leaving it pending", "id", msg.ID, "error", err)
+		return
+	}
+	if err := consumer.Ack(ctx, msg.ID); err != nil {
+		slog.Error("could not ack message", "id", msg.ID, "error", err)
+	}
+}
 
-		// Determine message type and process accordingly.
-		var genericMsg types.GenericMessage
-		if err := json.Unmarshal(messageData, &genericMsg); err != nil {
-			slog.Error("could not unmarshal generic message", "error", err)
-			continue
-		}
+// handleMessage writes one engine message to the database. Messages that cannot
+// be decoded are logged and reported as done, since retrying would not help.
+func handleMessage(messageData []byte) error {
+	slog.Info("received message from stream", "data", string(messageData))
 
-		switch genericMsg.Type {
-		case "TRADE_ADDED":
-			var msg types.DBTradeMessage
-			if err := json.Unmarshal(messageData, &msg); err != nil {
-				slog.Error("could not unmarshal trade message", "error", err)
-				continue
-			}
-			handleTradeAdded(msg)
+	// Determine message type and process accordingly.
+	var genericMsg types.GenericMessage
+	if err := json.Unmarshal(messageData, &genericMsg); err != nil {
+		slog.Error("could not unmarshal generic message", "error", err)
+		return nil
+	}
 
-		case "ORDER_UPDATE":
-			var msg types.DBOrderMessage
-			if err := json.Unmarshal(messageData, &msg); err != nil {
-				slog.Error("could not unmarshal order message", "error", err)
-				continue
-			}
-			handleOrderUpdate(msg)
+	switch genericMsg.Type {
+	case "TRADE_ADDED":
+		var msg types.DBTradeMessage
+		if err := json.Unmarshal(messageData, &msg); err != nil {
+			slog.Error("could not unmarshal trade message", "error", err)
+			return nil
+		}
+		return handleTradeAdded(msg)
 
-		default:
-			slog.Warn("received unknown message type", "type", genericMsg.Type)
+	case "ORDER_UPDATE":
+		var msg types.DBOrderMessage
+		if err := json.Unmarshal(messageData, &msg); err != nil {
+			slog.Error("could not unmarshal order message", "error", err)
+			return nil
 		}
+		return handleOrderUpdate(msg)
+
+	case "ORDER_TRIGGERED":
+		var msg types.DBOrderMessage
+		if err := json.Unmarshal(messageData, &msg); err != nil {
+			slog.Error("could not unmarshal order message", "error", err)
+			return nil
+		}
+		return handleOrderTriggered(msg)
+
+	default:
+		slog.Warn("received unknown message type", "type", genericMsg.Type)
+		return nil
 	}
 }
 
-func handleTradeAdded(msg types.DBTradeMessage) {
-	slog.Info("processing TRADE_ADDED message", "trade_id", msg.ID)
+func handleTradeAdded(msg types.DBTradeMessage) error {
+	slog.Info("processing TRADE_ADDED message", "trade_id", msg.ID, "market", msg.Market, "market_trade_id", msg.TradeID, "sequence", msg.Sequence)
 	trade := database.Trade{
 		ID:            msg.ID,
+		TradeID:       msg.TradeID,
+		Sequence:      msg.Sequence,
 		IsBuyerMaker:  msg.IsBuyerMaker,
 		Price:         msg.Price,
 		Quantity:      msg.Quantity,
 		QuoteQuantity: msg.QuoteQuantity,
 		Timestamp:     time.UnixMilli(msg.Timestamp),
 		Market:        msg.Market,
+
+		MakerOrderID: msg.MakerOrderID,
+		TakerOrderID: msg.TakerOrderID,
+		MakerUserID:  msg.MakerUserID,
+		TakerUserID:  msg.TakerUserID,
+		TakerSide:    string(msg.TakerSide),
+
+		BuyerID:   msg.BuyerID,
+		SellerID:  msg.SellerID,
+		BuyerFee:  msg.BuyerFee,
+		SellerFee: msg.SellerFee,
+	}
+
+	entries, err := ledgerEntries(msg)
+	if err != nil {
+		// The message itself is bad; retrying it would fail the same way.
+		slog.Error("could not build ledger entries for trade", "trade_id", msg.ID, "error", err)
+		return nil
+	}
+
+	// The trade and its ledger entries are written together or not at all,
+	// so the ledger never misses a trade or books one twice. A trade ID we
+	// already have means the message was delivered twice.
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&trade)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			slog.Warn("skipping duplicate trade", "market", msg.Market, "market_trade_id", msg.TradeID)
+			return nil
+		}
+		return tx.Create(&entries).Error
+	})
+	if err != nil {
+		return fmt.Errorf("create trade: %w", err)
+	}
+	return nil
+}
+
+// ledgerEntries turns a trade message into its balanced double-entry bookings.
+func ledgerEntries(msg types.DBTradeMessage) ([]database.LedgerEntry, error) {
+	quantity, err := decimal.NewFromString(msg.Quantity)
+	if err != nil {
+		return nil, err
+	}
+	quote, err := decimal.NewFromString(msg.QuoteQuantity)
+	if err != nil {
+		return nil, err
+	}
+	return database.TradeEntries(database.TradeSettlement{
+		TradeID:    msg.ID,
+		BuyerID:    msg.BuyerID,
+		SellerID:   msg.SellerID,
+		BaseAsset:  msg.BaseAsset,
+		QuoteAsset: msg.QuoteAsset,
+		Quantity:   quantity,
+		Quote:      quote,
+		BuyerFee:   msg.BuyerFee,
+		SellerFee:  msg.SellerFee,
+	})
+}
+
+func handleOrderUpdate(msg types.DBOrderMessage) error {
+	slog.Info("processing ORDER_UPDATE message", "order_id", msg.OrderID, "status", msg.Status)
+	order := database.Order{
+		ID:          msg.OrderID,
+		UserID:      msg.UserID,
+		ExecutedQty: msg.ExecutedQty,
+		Market:      msg.Market,
+		Price:       msg.Price,
+		Quantity:    msg.Quantity,
+		Side:        string(msg.Side),
+		Status:      string(msg.Status),
+		Sequence:    msg.Sequence,
 	}
 
-	if result := database.DB.Create(&trade); result.Error != nil {
-		slog.Error("failed to create trade in db", "error", result.Error)
+	// The first update for an order creates the row; later ones move its executed
+	// quantity and status forward and pick up any amended price or quantity.
+	// An update from an older engine event than the one stored is stale and ignored.
+	result := database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"executed_qty", "status", "price", "quantity", "sequence"}),
+		Where:     clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "orders.sequence <= excluded.sequence"}}},
+	}).Create(&order)
+	if result.Error != nil {
+		return fmt.Errorf("upsert order: %w", result.Error)
 	}
+	return nil
 }
 
-func handleOrderUpdate(msg types.DBOrderMessage) {
-	slog.Info("processing ORDER_UPDATE message", "order_id", msg.OrderID)
+func handleOrderTriggered(msg types.DBOrderMessage) error {
+	slog.Info("processing ORDER_TRIGGERED message", "order_id", msg.OrderID)
+	triggeredAt := time.UnixMilli(msg.TriggeredAt)
 	order := database.Order{
 		ID:          msg.OrderID,
+		UserID:      msg.UserID,
 		ExecutedQty: msg.ExecutedQty,
 		Market:      msg.Market,
 		Price:       msg.Price,
 		Quantity:    msg.Quantity,
 		Side:        string(msg.Side),
+		Status:      string(msg.Status),
+		TriggeredAt: &triggeredAt,
 	}
 
-	// This assumes an order is created on first update.
-	// You might want to use `FirstOrCreate` or `Updates` for more complex logic.
-	if result := database.DB.Create(&order); result.Error != nil {
-		slog.Error("failed to create order in db", "error", result.Error)
+	// The ORDER_UPDATE that follows carries the triggered order's new status;
+	// here we only record when it was triggered.
+	result := database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"triggered_at"}),
+	}).Create(&order)
+	if result.Error != nil {
+		return fmt.Errorf("record order trigger: %w", result.Error)
 	}
+	return nil
 }
@@ -3,35 +3,44 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/Utsav7428/ChronoXchange/internal/matching"
+	"github.com/Utsav7428/ChronoXchange/internal/bus"
+	"github.com/Utsav7428/ChronoXchange/internal/engine"
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/internal/wal"
 	"github.com/Utsav7428/ChronoXchange/pkg/types"
 
-	"github.com/google/uuid"
 	"github.com/joho/godotenv"
-	"github.com/redis/go-redis/v9"
 )
 
 const (
-	apiQueue         = "messages"
-	dbProcessorQueue = "db_processor"
-)
+	// apiQueue carries commands from the API, read through the engineGroup
+	// consumer group; dbProcessorQueue carries engine output to the db-processor.
+	apiQueue         = "engine_commands"
+	engineGroup      = "engine"
+	dbProcessorQueue = "db_events"
+	wsTopic          = "ws-messages"
 
-// APIRequestWrapper corresponds to the `MessageWrapper` in the Rust engine.
-type APIRequestWrapper struct {
-	ClientID string          `json:"client_id"` // The channel to send the API response back on
-	UserID   uuid.UUID       `json:"user_id"`
-	Message  json.RawMessage `json:"message"` // The actual command payload
-}
+	// expiryInterval bounds how late a GTD order can expire while the queue is idle.
+	expiryInterval = time.Second
 
-// APIMessage corresponds to the `MessageFromApi` enum.
-type APIMessage struct {
-	Type string                `json:"type"`
-	Data types.CreateOrderData `json:"data"`
-}
+	// defaultWALPath is used when ENGINE_WAL_PATH is not set.
+	defaultWALPath = "engine.wal"
+
+	// defaultSnapshotDir and defaultSnapshotInterval are used when
+	// ENGINE_SNAPSHOT_DIR and SNAPSHOT_INTERVAL are not set.
+	defaultSnapshotDir      = "snapshots"
+	defaultSnapshotInterval = time.Minute
+
+	// defaultHashInterval is used when REPLICATION_HASH_INTERVAL is not set.
+	defaultHashInterval = 10 * time.Second
+)
 
 func main() {
 	// 1. Initialize Logger
@@ -43,102 +52,287 @@ func main() {
 		slog.Info("No .env file found, using environment variables")
 	}
 
-	// 2. Connect to Redis
-	redisURL := os.Getenv("REDIS_URL")
-	opts, err := redis.ParseURL(redisURL)
+	// 2. Connect to the message bus
+	messages, err := bus.DialRedis(os.Getenv("REDIS_URL"))
 	if err != nil {
 		slog.Error("could not parse redis url", "error", err)
 		os.Exit(1)
 	}
-	redisClient := redis.NewClient(opts)
-	ctx := context.Background()
 
-	// 3. Initialize the Orderbook
-	// For now, we hardcode one market like in the Rust example.
-	orderbook := matching.NewOrderbook("SOL_USDC")
-	slog.Info("Matching engine started", "market", "SOL_USDC")
+	// Output is published with a context of its own so that the command in
+	// progress still gets its replies out when shutdown begins.
+	pubCtx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 3. Load the market registry and create one orderbook per market
+	registry, err := markets.LoadFromEnv()
+	if err != nil {
+		slog.Error("could not load market registry", "error", err)
+		os.Exit(1)
+	}
+
+	// 4. Load the latest snapshot, then replay the write-ahead log entries after it
+	snapshotDir := os.Getenv("ENGINE_SNAPSHOT_DIR")
+	if snapshotDir == "" {
+		snapshotDir = defaultSnapshotDir
+	}
+	snapshotInterval := defaultSnapshotInterval
+	if v := os.Getenv("SNAPSHOT_INTERVAL"); v != "" {
+		if snapshotInterval, err = time.ParseDuration(v); err != nil || snapshotInterval <= 0 {
+			slog.Error("invalid SNAPSHOT_INTERVAL", "value", v, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	walPath := os.Getenv("ENGINE_WAL_PATH")
+	if walPath == "" {
+		walPath = defaultWALPath
+	}
+	journal, err := wal.Open(walPath)
+	if err != nil {
+		slog.Error("could not open write-ahead log", "path", walPath, "error", err)
+		os.Exit(1)
+	}
+	defer journal.Close()
+
+	// Every write to the bus is fenced, so only the engine holding the latest
+	// fencing token can reply, publish fills or ship journal records.
+	fenced := newFence(pubCtx, messages, walPath+tokenFileSuffix)
+	eng := engine.New(registry, &busPublisher{ctx: pubCtx, bus: fenced.bus, fence: fenced}, engine.WithJournal(journal), engine.WithReplica(fenced))
+	loaded, err := eng.LoadSnapshot(snapshotDir)
+	if err != nil {
+		// Every snapshot is damaged. A log that was never compacted still
+		// rebuilds the same state; Recover refuses one that was.
+		slog.Error("could not load any snapshot, replaying the full log", "dir", snapshotDir, "error", err)
+	} else if loaded != "" {
+		slog.Info("snapshot loaded", "path", loaded, "sequence", eng.Sequence())
+	}
+	if err := eng.Recover(); err != nil {
+		slog.Error("could not replay write-ahead log", "path", walPath, "error", err)
+		os.Exit(1)
+	}
+	snaps := &snapshots{dir: snapshotDir, interval: snapshotInterval, seq: eng.Sequence(), last: time.Now()}
+
+	// 5. A standby follows the primary's journal until it is promoted. A primary
+	// takes the fencing token straight away if it is the first, or was the
+	// last, to hold one. Otherwise a standby has taken over from it, and it
+	// must not fence that off; ENGINE_TAKEOVER overrides this.
+	hashInterval := defaultHashInterval
+	if v := os.Getenv("REPLICATION_HASH_INTERVAL"); v != "" {
+		if hashInterval, err = time.ParseDuration(v); err != nil || hashInterval <= 0 {
+			slog.Error("invalid REPLICATION_HASH_INTERVAL", "value", v, "error", err)
+			os.Exit(1)
+		}
+	}
+	switch mode := os.Getenv("ENGINE_MODE"); mode {
+	case "standby":
+		if err := standby(ctx, messages, fenced, eng, snaps); err != nil {
+			if ctx.Err() == nil {
+				slog.Error("standby stopped following the primary", "sequence", eng.Sequence(), "error", err)
+				os.Exit(1)
+			}
+			slog.Info("shutting down")
+			snaps.final(eng)
+			return
+		}
+	case "", "primary":
+		take := fenced.claim
+		if os.Getenv("ENGINE_TAKEOVER") == "true" {
+			slog.Warn("taking over as primary regardless of the current fencing token")
+			take = fenced.acquire
+		}
+		token, err := take()
+		if errors.Is(err, bus.ErrFenced) {
+			slog.Error("another engine has taken over as primary since this one last ran; reseed this one from its snapshot and start it as a standby, or set ENGINE_TAKEOVER=true")
+			os.Exit(1)
+		}
+		if err != nil {
+			slog.Error("could not take the fencing token", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("engine running as primary", "token", token)
+	default:
+		slog.Error("ENGINE_MODE must be primary or standby", "value", mode)
+		os.Exit(1)
+	}
+	for _, m := range registry.All() {
+		slog.Info("Matching engine started", "market", m.Symbol, "status", m.Status)
+	}
+
+	// Commands this engine, or the one it replaced, took but never acknowledged
+	// come first. Any it already applied are recognised by their delivery ID.
+	consumer := consumerName("ENGINE_CONSUMER")
+	commands, err := messages.Consume(ctx, apiQueue, engineGroup, consumer)
+	if err != nil {
+		slog.Error("could not join the engine consumer group", "error", err)
+		os.Exit(1)
+	}
+	reclaimed, err := commands.Reclaim(ctx, 0)
+	if err != nil {
+		slog.Error("could not reclaim pending commands", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("consuming commands", "consumer", consumer, "reclaimed", reclaimed, "last_delivery_id", eng.LastDelivery())
+
+	// 6. Main Loop: Listen for API commands until asked to stop or replaced
+	hashSeq, lastHash := eng.Sequence(), time.Now()
+	for !fenced.Fenced() {
+		// Expire GTD orders that came due since the last command.
+		eng.ExpireDue(time.Now())
+
+		// Snapshot on a timer, between commands, if anything changed since the last one.
+		snaps.maybe(eng)
+
+		// Let standbys check themselves against this engine's state now and then.
+		if time.Since(lastHash) >= hashInterval {
+			if eng.Sequence() != hashSeq {
+				checkpoint(fenced, eng)
+				hashSeq = eng.Sequence()
+			}
+			lastHash = time.Now()
+		}
 
-	// 4. Main Loop: Listen for API commands
-	for {
-		// Block until a command is available in the 'messages' queue.
-		result, err := redisClient.BRPop(ctx, 0, apiQueue).Result()
+		// Wait for a command, waking up regularly for expiries.
+		msg, err := commands.Receive(ctx, expiryInterval)
+		if errors.Is(err, bus.ErrNoMessage) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
 		if err != nil {
-			slog.Error("error popping from api queue", "error", err)
+			slog.Error("error reading api queue", "error", err)
+			time.Sleep(time.Second)
 			continue
 		}
 
 		// Unmarshal the outer wrapper to get the client_id and the message payload.
-		var wrappedReq APIRequestWrapper
-		if err := json.Unmarshal([]byte(result[1]), &wrappedReq); err != nil {
-			slog.Error("could not unmarshal request wrapper", "error", err)
+		// A command that cannot be read never will be, so it is acked and dropped.
+		var wrappedReq engine.APIRequestWrapper
+		if err := json.Unmarshal(msg.Data, &wrappedReq); err != nil {
+			slog.Error("could not unmarshal request wrapper", "id", msg.ID, "error", err)
+			ackCommand(pubCtx, commands, msg.ID)
 			continue
 		}
+		wrappedReq.DeliveryID = msg.ID
 
-		slog.Info("processing request", "client_id", wrappedReq.ClientID, "user_id", wrappedReq.UserID)
+		slog.Info("processing request", "client_id", wrappedReq.ClientID, "user_id", wrappedReq.UserID, "delivery_id", msg.ID)
 
-		// Unmarshal the inner message to determine the command type.
-		var apiMsg APIMessage
-		if err := json.Unmarshal(wrappedReq.Message, &apiMsg); err != nil {
-			slog.Error("could not unmarshal api message", "error", err)
-			continue
+		// 7. Process the command; the engine replies to the client's address.
+		// It is acked only afterwards, and not at all if another engine took
+		// over meanwhile, so that the new primary picks it up if it has to.
+		eng.Process(wrappedReq)
+		if fenced.Fenced() {
+			break
 		}
+		ackCommand(pubCtx, commands, msg.ID)
+	}
 
-		// 5. Process the command
-		switch apiMsg.Type {
-		case "CREATE_ORDER":
-			// The AddOrder method returns the trades (fills) that resulted from the new order.
-			fills := orderbook.AddOrder(apiMsg.Data)
+	// An engine that has been replaced applied commands nobody else saw, so
+	// its state must not be saved; it has to be reseeded from the new primary.
+	if fenced.Fenced() {
+		slog.Error("another engine took over as primary, stopping", "sequence", eng.Sequence())
+		os.Exit(1)
+	}
 
-			// After processing, publish results to other services.
-			publishResults(ctx, redisClient, fills, "SOL_USDC")
+	// 8. Graceful shutdown: snapshot so the next start has nothing to replay
+	slog.Info("shutting down")
+	snaps.final(eng)
+}
 
-			slog.Info("order processed", "fills", len(fills))
+// snapshots takes the engine's snapshots on a timer and at shutdown.
+type snapshots struct {
+	dir      string
+	interval time.Duration
+	seq      uint64    // Sequence number of the last snapshot taken
+	last     time.Time // When the timer last fired
+}
 
-			// TODO: Send a confirmation back to the API service on the `wrappedReq.ClientID` channel.
+// maybe takes a snapshot if the interval has passed and anything changed since the last one.
+func (s *snapshots) maybe(eng *engine.Engine) {
+	if time.Since(s.last) < s.interval {
+		return
+	}
+	if eng.Sequence() != s.seq {
+		s.final(eng)
+	}
+	s.last = time.Now()
+}
 
-		// TODO: Add cases for CANCEL_ORDER, GET_DEPTH, etc.
+// final takes a snapshot if anything changed since the last one.
+func (s *snapshots) final(eng *engine.Engine) {
+	if eng.Sequence() == s.seq {
+		return
+	}
+	start := time.Now()
+	path, err := eng.SaveSnapshot(s.dir)
+	if err != nil {
+		// A failed snapshot only means a longer replay on the next start.
+		slog.Error("could not save snapshot", "dir", s.dir, "error", err)
+		return
+	}
+	s.seq = eng.Sequence()
+	slog.Info("snapshot saved", "path", path, "sequence", s.seq, "took", time.Since(start))
+}
 
-		default:
-			slog.Warn("received unknown message type", "type", apiMsg.Type)
-		}
+// ackCommand acknowledges a command. If that fails the command is delivered
+// again after a restart, and the engine skips it then.
+func ackCommand(ctx context.Context, q bus.Consumer, id string) {
+	if err := q.Ack(ctx, id); err != nil {
+		slog.Error("could not ack command", "id", id, "error", err)
 	}
 }
 
-// publishResults sends data to the db-processor and WebSocket services via Redis.
-func publishResults(ctx context.Context, rdb *redis.Client, fills []types.Fill, market string) {
-	for _, fill := range fills {
-		// --- Task 1: Publish to DB Processor ---
-		dbTradeMsg := types.DBTradeMessage{
-			Type:          "TRADE_ADDED",
-			ID:            uuid.New(),
-			IsBuyerMaker:  false, // Simplified for now
-			Price:         fill.Price.String(),
-			Quantity:      fill.Qty.String(),
-			QuoteQuantity: fill.Price.Mul(fill.Qty).String(),
-			Timestamp:     time.Now().UnixMilli(),
-			Market:        market,
-		}
-		dbPayload, _ := json.Marshal(dbTradeMsg)
-		if err := rdb.LPush(ctx, dbProcessorQueue, dbPayload).Err(); err != nil {
-			slog.Error("failed to push to db processor queue", "error", err)
-		}
+// checkpoint ships the engine's state hash to standbys.
+func checkpoint(f *fence, eng *engine.Engine) {
+	hash, err := eng.StateHash()
+	if err == nil {
+		err = f.Checkpoint(eng.Sequence(), hash)
+	}
+	if err != nil {
+		slog.Error("could not ship state hash to standby", "sequence", eng.Sequence(), "error", err)
+	}
+}
 
-		// --- Task 2: Publish to WebSocket Hub ---
-		wsTradeData := types.TradeData{
-			EventType: "trade",
-			TradeID:   fill.TradeID,
-			Price:     fill.Price,
-			Quantity:  fill.Qty,
-			Market:    market,
-		}
-		wsMsg := types.WsMessage{
-			Stream: "trades@" + market,
-			Data:   wsTradeData,
-		}
-		wsPayload, _ := json.Marshal(wsMsg)
-		// Publish to a general topic that the WebSocket server will listen to.
-		if err := rdb.Publish(ctx, "ws-messages", wsPayload).Err(); err != nil {
-			slog.Error("failed to publish to ws topic", "error", err)
-		}
+// consumerName names this process within a consumer group: the value of env
+// if set, otherwise the host name. It must stay the same across restarts so
+// that the process picks up the commands it left pending.
+func consumerName(env string) string {
+	if name := os.Getenv(env); name != "" {
+		return name
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "engine"
+}
+
+// busPublisher sends engine output to the other services over the message bus.
+type busPublisher struct {
+	ctx   context.Context
+	bus   bus.Bus
+	fence *fence
+}
+
+func (p *busPublisher) Respond(clientID string, resp types.APIResponse) {
+	payload, _ := json.Marshal(resp)
+	if err := p.fence.check(p.bus.Reply(p.ctx, clientID, payload)); err != nil {
+		slog.Error("failed to publish api response", "client_id", clientID, "error", err)
+	}
+}
+
+func (p *busPublisher) PushDB(msg interface{}) {
+	payload, _ := json.Marshal(msg)
+	if err := p.fence.check(p.bus.Push(p.ctx, dbProcessorQueue, payload)); err != nil {
+		slog.Error("failed to push to db processor queue", "error", err)
+	}
+}
+
+func (p *busPublisher) PublishWS(msg types.WsMessage) {
+	payload, _ := json.Marshal(msg)
+	// Publish to a general topic that the WebSocket server will listen to.
+	if err := p.fence.check(p.bus.Publish(p.ctx, wsTopic, payload)); err != nil {
+		slog.Error("failed to publish to ws topic", "error", err)
 	}
 }
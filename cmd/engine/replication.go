@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Utsav7428/ChronoXchange/internal/bus"
+	"github.com/Utsav7428/ChronoXchange/internal/engine"
+)
+
+const (
+	// epochKey holds the fencing token of the engine allowed to publish.
+	// Taking over as primary increments it, which fences off the previous one.
+	epochKey = "engine:epoch"
+	// tokenFileSuffix names the file, next to the write-ahead log, that keeps
+	// the last fencing token an engine took across restarts.
+	tokenFileSuffix = ".epoch"
+	// journalStream is the log carrying the primary's journal records and
+	// state hashes to standbys.
+	journalStream = "engine_journal"
+	// journalStreamMaxLen bounds the stream; a standby further behind than
+	// this must be reseeded from a copy of the primary's snapshot.
+	journalStreamMaxLen = 1_000_000
+	// adminChannel is where operators send admin commands such as PROMOTE.
+	adminChannel = "engine_admin"
+
+	// Kinds of entry on the journal stream.
+	streamRecord = "record"
+	streamHash   = "hash"
+)
+
+// streamEntry is one entry on the journal stream.
+type streamEntry struct {
+	Kind   string          `json:"kind"`
+	Seq    uint64          `json:"seq"`
+	Record json.RawMessage `json:"record,omitempty"` // The journal record, for streamRecord
+	Hash   string          `json:"hash,omitempty"`   // The hex state hash, for streamHash
+}
+
+// engineBus is what the engine needs of the message bus: everything the
+// other services use, and fencing for its own writes.
+type engineBus interface {
+	bus.Bus
+	bus.Fencing
+}
+
+// adminCommand is a message on the admin channel.
+type adminCommand struct {
+	Type string `json:"type"` // "PROMOTE"
+}
+
+// fence guards every write the engine makes to the bus with its fencing token.
+type fence struct {
+	ctx      context.Context
+	messages engineBus    // Unfenced, for reads and taking tokens
+	bus      bus.Bus      // Writes through it are refused once the token is stale
+	token    atomic.Int64 // Zero until the engine becomes primary
+	fenced   atomic.Bool  // Set once a write is refused because another engine took over
+	path     string       // File keeping the last token taken, across restarts
+}
+
+// newFence returns a fence for writes made through messages, keeping the
+// engine's token in the file at path.
+func newFence(ctx context.Context, messages engineBus, path string) *fence {
+	f := &fence{ctx: ctx, messages: messages, path: path}
+	f.bus = messages.Fenced(epochKey, f.token.Load)
+	return f
+}
+
+// acquire takes a new fencing token, fencing off whichever engine held the last one.
+func (f *fence) acquire() (int64, error) {
+	token, err := f.messages.TakeToken(f.ctx, epochKey)
+	if err != nil {
+		return 0, err
+	}
+	return token, f.keep(token)
+}
+
+// claim takes a new fencing token only if this engine took the last one
+// before it restarted, or if no engine has taken one yet. It fails with
+// bus.ErrFenced if another engine has taken over since: that engine is the
+// primary now, and this one is behind it.
+func (f *fence) claim() (int64, error) {
+	held, err := f.held()
+	if err != nil {
+		return 0, err
+	}
+	token, err := f.messages.ClaimToken(f.ctx, epochKey, held)
+	if err != nil {
+		return 0, err
+	}
+	return token, f.keep(token)
+}
+
+// held returns the last token this engine took, or zero if it never took one.
+func (f *fence) held() (int64, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// keep makes token the one the engine writes with, and saves it for the next start.
+func (f *fence) keep(token int64) error {
+	f.token.Store(token)
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(token, 10)+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// Fenced reports whether another engine has taken over from this one.
+func (f *fence) Fenced() bool {
+	return f.fenced.Load()
+}
+
+// check notes a write refused because another engine took over, and returns err.
+func (f *fence) check(err error) error {
+	if errors.Is(err, bus.ErrFenced) {
+		f.fenced.Store(true)
+	}
+	return err
+}
+
+// Ship adds a journal record to the journal stream, making f an engine.Replica.
+func (f *fence) Ship(seq uint64, payload []byte) error {
+	return f.appendEntry(streamEntry{Kind: streamRecord, Seq: seq, Record: payload})
+}
+
+// Checkpoint adds the engine's state hash at seq to the journal stream, for
+// standbys to check themselves against once they reach the same point.
+func (f *fence) Checkpoint(seq uint64, hash []byte) error {
+	return f.appendEntry(streamEntry{Kind: streamHash, Seq: seq, Hash: hex.EncodeToString(hash)})
+}
+
+func (f *fence) appendEntry(entry streamEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return f.check(f.bus.Append(f.ctx, journalStream, journalStreamMaxLen, data))
+}
+
+// standby follows the primary's journal stream until it is promoted or ctx is
+// done. On PROMOTE it takes the fencing token first, which stops the old
+// primary from adding anything more, and then applies whatever the old
+// primary had already shipped, so it takes over with nothing missing.
+func standby(ctx context.Context, messages bus.PubSub, f *fence, eng *engine.Engine, snaps *snapshots) error {
+	sub, err := messages.Subscribe(ctx, adminChannel)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	admin := sub.Messages()
+
+	slog.Info("engine running as standby", "sequence", eng.Sequence())
+	lastID := "0"
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-admin:
+			var cmd adminCommand
+			if err := json.Unmarshal(msg, &cmd); err != nil || cmd.Type != "PROMOTE" {
+				slog.Warn("ignoring admin command", "payload", string(msg))
+				break
+			}
+			token, err := f.acquire()
+			if err != nil {
+				slog.Error("could not take the fencing token", "error", err)
+				break
+			}
+			if _, err := follow(ctx, f.messages, eng, lastID, 0); err != nil {
+				return err
+			}
+			slog.Info("standby promoted to primary", "token", token, "sequence", eng.Sequence())
+			return nil
+		default:
+		}
+
+		snaps.maybe(eng)
+
+		if lastID, err = follow(ctx, f.messages, eng, lastID, time.Second); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, engine.ErrReplicationGap) || errors.Is(err, engine.ErrStateDiverged) {
+				return err
+			}
+			slog.Error("error reading journal stream", "error", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// follow applies journal stream entries after lastID until there are none
+// left, waiting up to wait for the first batch (zero not to wait), and returns
+// the ID of the last entry applied.
+func follow(ctx context.Context, log bus.Log, eng *engine.Engine, lastID string, wait time.Duration) (string, error) {
+	for {
+		msgs, err := log.Read(ctx, journalStream, lastID, 1000, wait)
+		if errors.Is(err, bus.ErrNoMessage) {
+			return lastID, nil
+		}
+		if err != nil {
+			return lastID, err
+		}
+		for _, msg := range msgs {
+			if err := apply(eng, msg.Data); err != nil {
+				return lastID, fmt.Errorf("journal stream entry %s: %w", msg.ID, err)
+			}
+			lastID = msg.ID
+		}
+		// Keep reading without waiting until the stream is drained.
+		wait = 0
+	}
+}
+
+// apply applies one journal stream entry to a standby.
+func apply(eng *engine.Engine, data []byte) error {
+	var entry streamEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+
+	switch entry.Kind {
+	case streamRecord:
+		return eng.Follow(entry.Seq, entry.Record)
+	case streamHash:
+		// Hashes from before the standby's starting point cannot be checked.
+		if entry.Seq < eng.Sequence() {
+			return nil
+		}
+		hash, err := hex.DecodeString(entry.Hash)
+		if err != nil {
+			return err
+		}
+		if err := eng.Verify(entry.Seq, hash); err != nil {
+			return err
+		}
+		slog.Info("standby state verified", "sequence", entry.Seq)
+		return nil
+	default:
+		slog.Warn("ignoring unknown journal stream entry", "kind", entry.Kind)
+		return nil
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/Utsav7428/ChronoXchange/internal/bus"
+	"github.com/Utsav7428/ChronoXchange/internal/engine"
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/internal/wal"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestStandbyFollowsAndFencesOffThePrimaryOverMemoryBus(t *testing.T) {
+	ctx := context.Background()
+	messages := bus.NewMemory()
+	dir := t.TempDir()
+	// Set up the way main does, over the in-process bus.
+	newEngine := func(name string, ships bool) (*engine.Engine, *fence) {
+		t.Helper()
+		journal, err := wal.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { journal.Close() })
+		f := newFence(ctx, messages, filepath.Join(dir, name+tokenFileSuffix))
+		opts := []engine.Option{engine.WithJournal(journal)}
+		if ships {
+			opts = append(opts, engine.WithReplica(f))
+		}
+		return engine.New(markets.Default(), &busPublisher{ctx: ctx, bus: f.bus, fence: f}, opts...), f
+	}
+
+	primary, primaryFence := newEngine("primary.wal", true)
+	if _, err := primaryFence.claim(); err != nil {
+		t.Fatal(err)
+	}
+	standbyEngine, standbyFence := newEngine("standby.wal", false)
+
+	user := uuid.New()
+	onRamp := func(amount int64) {
+		t.Helper()
+		payload, _ := json.Marshal(types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(amount)})
+		msg, _ := json.Marshal(engine.APIMessage{Type: engine.OnRamp, Data: payload})
+		primary.Process(engine.APIRequestWrapper{ClientID: "client", UserID: user, Message: msg})
+	}
+	onRamp(100)
+	onRamp(10)
+	checkpoint(primaryFence, primary)
+
+	lastID, err := follow(ctx, messages, standbyEngine, "0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if standbyEngine.Sequence() != primary.Sequence() {
+		t.Fatalf("standby at sequence %d, primary at %d", standbyEngine.Sequence(), primary.Sequence())
+	}
+
+	// Promotion fences off the primary: nothing it does from then on reaches
+	// the standby, and it learns that it has been replaced.
+	if _, err := standbyFence.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	onRamp(1)
+	if !primaryFence.Fenced() {
+		t.Fatal("expected the old primary to notice it was fenced off")
+	}
+	if _, err := follow(ctx, messages, standbyEngine, lastID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if standbyEngine.Sequence() != 2 {
+		t.Fatalf("expected the standby to stay at sequence 2, got %d", standbyEngine.Sequence())
+	}
+}
+
+func TestRestartedPrimaryDoesNotFenceOffItsSuccessor(t *testing.T) {
+	ctx := context.Background()
+	messages := bus.NewMemory()
+	dir := t.TempDir()
+	first := newFence(ctx, messages, filepath.Join(dir, "first.epoch"))
+	second := newFence(ctx, messages, filepath.Join(dir, "second.epoch"))
+
+	// The first primary to start takes the first token, and takes the next
+	// one each time it restarts as long as nobody has taken over.
+	for want := int64(1); want <= 2; want++ {
+		if token, err := first.claim(); err != nil || token != want {
+			t.Fatalf("first primary got token %d, %v; want %d", token, err, want)
+		}
+	}
+	if _, err := second.claim(); !errors.Is(err, bus.ErrFenced) {
+		t.Fatalf("expected an engine that never held the token to be refused, got %v", err)
+	}
+
+	// Once a standby is promoted, the old primary can no longer start as one.
+	if _, err := second.acquire(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.claim(); !errors.Is(err, bus.ErrFenced) {
+		t.Fatalf("expected the old primary to be refused, got %v", err)
+	}
+	if token, err := second.claim(); err != nil || token != 4 {
+		t.Fatalf("new primary got token %d, %v after a restart; want 4", token, err)
+	}
+
+	// Unless the operator says it should take over.
+	if token, err := first.acquire(); err != nil || token != 5 {
+		t.Fatalf("forced takeover got token %d, %v; want 5", token, err)
+	}
+}
@@ -7,11 +7,11 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/Utsav7428/ChronoXchange/internal/bus"
 	"github.com/Utsav7428/ChronoXchange/internal/hub"
 
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
-	"github.com/redis/go-redis/v9"
 )
 
 var upgrader = websocket.Upgrader{
@@ -34,28 +34,29 @@ func serveWs(h *hub.Hub, w http.ResponseWriter, r *http.Request) {
 	go client.ReadPump()
 }
 
-// listenToRedis subscribes to the Redis topic and forwards messages to the hub.
-func listenToRedis(ctx context.Context, h *hub.Hub) {
+// listenToBus subscribes to the engine's WebSocket topic and forwards messages to the hub.
+func listenToBus(ctx context.Context, h *hub.Hub) {
 	if err := godotenv.Load(); err != nil {
 		slog.Info("No .env file found")
 	}
-	redisURL := os.Getenv("REDIS_URL")
-	opts, err := redis.ParseURL(redisURL)
+	messages, err := bus.DialRedis(os.Getenv("REDIS_URL"))
 	if err != nil {
 		slog.Error("could not parse redis url", "error", err)
 		return
 	}
-	redisClient := redis.NewClient(opts)
 
-	slog.Info("Subscribing to ws-messages topic on Redis")
-	pubsub := redisClient.Subscribe(ctx, "ws-messages")
-	defer pubsub.Close()
+	slog.Info("Subscribing to ws-messages topic")
+	sub, err := messages.Subscribe(ctx, "ws-messages")
+	if err != nil {
+		slog.Error("could not subscribe to ws-messages", "error", err)
+		return
+	}
+	defer sub.Close()
 
-	ch := pubsub.Channel()
-	for msg := range ch {
-		// When a message is received from Redis, send it to the hub's broadcast channel.
-		slog.Info("received message from redis, broadcasting to clients", "msg", msg.Payload)
-		h.Broadcast <- []byte(msg.Payload)
+	for msg := range sub.Messages() {
+		// When a message is received from the bus, send it to the hub's broadcast channel.
+		slog.Info("received message from bus, broadcasting to clients", "msg", string(msg))
+		h.Broadcast <- msg
 	}
 }
 
@@ -64,7 +65,7 @@ func main() {
 	ctx := context.Background()
 
 	go h.Run()
-	go listenToRedis(ctx, h) // Start the Redis listener
+	go listenToBus(ctx, h) // Start the bus listener
 
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(h, w, r)
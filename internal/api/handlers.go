@@ -3,19 +3,23 @@ package api
 import (
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/Utsav7428/ChronoXchange/internal/bus"
 	"github.com/Utsav7428/ChronoXchange/internal/database"
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
 
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 
 	"github.com/Utsav7428/ChronoXchange/pkg/types"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"github.com/redis/go-redis/v9"
 	"github.com/shopspring/decimal"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -94,10 +98,32 @@ func Login(c *gin.Context) {
 }
 
 type createOrderRequest struct {
+	Market          string            `json:"market" binding:"required"`
+	Type            types.OrderType   `json:"type" binding:"omitempty,oneof=limit market stop_limit stop_market"`
+	Price           decimal.Decimal   `json:"price"`            // Required for limit orders
+	StopPrice       decimal.Decimal   `json:"stop_price"`       // Required for stop orders
+	DisplayQuantity decimal.Decimal   `json:"display_quantity"` // Iceberg orders only show this much at a time
+	Quantity        decimal.Decimal   `json:"quantity"`         // Base quantity
+	QuoteQuantity   decimal.Decimal   `json:"quote_quantity"`   // Market orders only, instead of quantity
+	MaxSlippage     decimal.Decimal   `json:"max_slippage"`     // Market orders only, e.g. "0.01" for 1%
+	Side            types.OrderSide   `json:"side" binding:"required"`
+	TimeInForce     types.TimeInForce `json:"time_in_force" binding:"omitempty,oneof=GTC IOC FOK GTD"`
+	ExpireAt        int64             `json:"expire_at"` // Unix milliseconds, GTD only
+	PostOnly        bool              `json:"post_only"`
+	PostOnlyReprice bool              `json:"post_only_reprice"` // Reprice a crossing post-only order instead of rejecting it
+
+	SelfTradePrevention types.SelfTradePrevention `json:"self_trade_prevention" binding:"omitempty,oneof=CANCEL_NEWEST CANCEL_OLDEST CANCEL_BOTH DECREMENT_AND_CANCEL"`
+}
+
+type amendOrderRequest struct {
 	Market   string          `json:"market" binding:"required"`
-	Price    decimal.Decimal `json:"price" binding:"required"`
-	Quantity decimal.Decimal `json:"quantity" binding:"required"`
-	Side     types.OrderSide `json:"side" binding:"required"`
+	Price    decimal.Decimal `json:"price"`    // New limit price, omit to keep the current one
+	Quantity decimal.Decimal `json:"quantity"` // New total quantity, omit to keep the current one
+}
+
+type onRampRequest struct {
+	Asset  string          `json:"asset" binding:"required"`
+	Amount decimal.Decimal `json:"amount"`
 }
 
 // APIRequestWrapper is the message format sent to the engine's queue.
@@ -109,8 +135,122 @@ type APIRequestWrapper struct {
 
 // APIMessage is the inner message payload.
 type APIMessage struct {
-	Type string                `json:"type"`
-	Data types.CreateOrderData `json:"data"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// engineQueue is the queue the engine reads commands from.
+const engineQueue = "engine_commands"
+
+// engineBus carries commands to the engine and its replies back. It is nil
+// until SetBus is called.
+var engineBus bus.RequestReply
+
+// errNoBus is returned when a request reaches the engine's handlers before SetBus is called.
+var errNoBus = errors.New("no message bus to reach the engine on")
+
+// SetBus gives the handlers the message bus to reach the engine through.
+func SetBus(b bus.RequestReply) {
+	engineBus = b
+}
+
+// defaultEngineTimeout is used when ENGINE_RESPONSE_TIMEOUT is unset or invalid.
+const defaultEngineTimeout = 5 * time.Second
+
+// errEngineTimeout is returned when the engine does not reply in time.
+var errEngineTimeout = errors.New("timed out waiting for engine response")
+
+// engineTimeout reads how long a request may wait for the engine, e.g. "5s".
+func engineTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("ENGINE_RESPONSE_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return defaultEngineTimeout
+	}
+	return timeout
+}
+
+// sendToEngine sends a command to the engine and waits for the engine to
+// reply to the address the bus gave this request.
+func sendToEngine(ctx context.Context, userID uuid.UUID, msgType string, data interface{}) (*types.APIResponse, error) {
+	if engineBus == nil {
+		return nil, errNoBus
+	}
+
+	// 1. Prepare the command for the engine
+	messagePayload, err := json.Marshal(APIMessage{Type: msgType, Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, engineTimeout())
+	defer cancel()
+
+	// 2. Send it, with the reply address as its client ID, and wait for the reply
+	reply, err := engineBus.Request(ctx, engineQueue, func(replyTo string) ([]byte, error) {
+		slog.Info("waiting for engine response", "client_id", replyTo)
+		return json.Marshal(APIRequestWrapper{
+			ClientID: replyTo,
+			UserID:   userID,
+			Message:  messagePayload,
+		})
+	})
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errEngineTimeout
+		}
+		return nil, err
+	}
+
+	var resp types.APIResponse
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// marketRegistry lets the API reject orders that break a market's rules
+// without a round trip to the engine. It is nil until SetMarkets is called.
+var marketRegistry *markets.Registry
+
+// SetMarkets gives the order handlers the market rules to check requests against.
+func SetMarkets(registry *markets.Registry) {
+	marketRegistry = registry
+}
+
+// rejectInvalid checks a request against its market's rules and, if it breaks one,
+// writes a 400 with the rule's code. It reports whether the request was rejected.
+func rejectInvalid(c *gin.Context, symbol string, validate func(markets.Market) error) bool {
+	if marketRegistry == nil {
+		return false
+	}
+	market, err := marketRegistry.Get(symbol)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": markets.CodeUnknownMarket})
+		return true
+	}
+	var invalid *markets.ValidationError
+	if err := validate(market); errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalid.Message, "code": invalid.Code})
+		return true
+	}
+	return false
+}
+
+// respondWithEngineResult translates the outcome of sendToEngine into an HTTP response.
+func respondWithEngineResult(c *gin.Context, resp *types.APIResponse, err error) {
+	switch {
+	case errors.Is(err, errEngineTimeout):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Engine did not respond in time"})
+	case err != nil:
+		slog.Error("engine request failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reach engine"})
+	case !resp.Success && resp.Code != "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": resp.Message, "code": resp.Code})
+	case !resp.Success:
+		c.JSON(http.StatusBadRequest, gin.H{"error": resp.Message})
+	default:
+		c.JSON(http.StatusOK, resp.Data)
+	}
 }
 
 func CreateOrder(c *gin.Context) {
@@ -123,50 +263,246 @@ func CreateOrder(c *gin.Context) {
 		return
 	}
 
-	// 2. Connect to Redis
-	redisURL := os.Getenv("REDIS_URL")
-	opts, _ := redis.ParseURL(redisURL)
-	redisClient := redis.NewClient(opts)
-	ctx := context.Background()
-
-	// 3. Prepare the command for the engine
+	// 2. Send the command to the engine and relay its result
 	orderData := types.CreateOrderData{
+		UserID:    userID.(uuid.UUID),
+		Market:    req.Market,
+		Type:      req.Type,
+		Price:     req.Price,
+		StopPrice: req.StopPrice,
+		Quantity:  req.Quantity,
+
+		DisplayQuantity: req.DisplayQuantity,
+		Side:            req.Side,
+		QuoteQuantity:   req.QuoteQuantity,
+		MaxSlippage:     req.MaxSlippage,
+		TimeInForce:     req.TimeInForce,
+		ExpireAt:        req.ExpireAt,
+
+		PostOnly:        req.PostOnly,
+		PostOnlyReprice: req.PostOnlyReprice,
+
+		SelfTradePrevention: req.SelfTradePrevention,
+	}
+	if rejectInvalid(c, req.Market, func(m markets.Market) error { return m.ValidateOrder(orderData) }) {
+		return
+	}
+	orderData.FeeLevel, _ = feeLevel(userID.(uuid.UUID))
+	resp, err := sendToEngine(c.Request.Context(), userID.(uuid.UUID), "CREATE_ORDER", orderData)
+	respondWithEngineResult(c, resp, err)
+}
+
+func CancelOrder(c *gin.Context) {
+	// 1. Get UserID from middleware and the order to cancel from the request
+	userID, _ := c.Get("userID")
+
+	orderID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	market := c.Query("market")
+	if market == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "market query parameter is required"})
+		return
+	}
+
+	// 2. Send the command to the engine and relay its result
+	cancelData := types.CancelOrderData{
+		UserID:  userID.(uuid.UUID),
+		OrderID: orderID,
+		Market:  market,
+	}
+	resp, err := sendToEngine(c.Request.Context(), userID.(uuid.UUID), "CANCEL_ORDER", cancelData)
+	respondWithEngineResult(c, resp, err)
+}
+
+func AmendOrder(c *gin.Context) {
+	// 1. Get UserID from middleware, the order to amend and the new values
+	userID, _ := c.Get("userID")
+
+	orderID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+		return
+	}
+
+	var req amendOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Price.IsZero() && req.Quantity.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price or quantity is required"})
+		return
+	}
+
+	// 2. Send the command to the engine and relay its result
+	amendData := types.AmendOrderData{
 		UserID:   userID.(uuid.UUID),
+		OrderID:  orderID,
 		Market:   req.Market,
 		Price:    req.Price,
 		Quantity: req.Quantity,
-		Side:     req.Side,
 	}
-	apiMsg := APIMessage{Type: "CREATE_ORDER", Data: orderData}
-	messagePayload, _ := json.Marshal(apiMsg)
+	if rejectInvalid(c, req.Market, func(m markets.Market) error { return m.ValidateAmend(amendData) }) {
+		return
+	}
+	resp, err := sendToEngine(c.Request.Context(), userID.(uuid.UUID), "AMEND_ORDER", amendData)
+	respondWithEngineResult(c, resp, err)
+}
 
-	// This is the unique channel the API will listen on for a response.
-	responseChannel := uuid.New().String()
+// defaultDepthLimit is the number of price levels returned when no limit is given.
+const defaultDepthLimit = 20
 
-	wrappedReq := APIRequestWrapper{
-		ClientID: responseChannel,
-		UserID:   userID.(uuid.UUID),
-		Message:  messagePayload,
+func GetDepth(c *gin.Context) {
+	// 1. Parse the market and the number of levels requested
+	market := c.Query("market")
+	if market == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "market query parameter is required"})
+		return
 	}
 
-	wrappedPayload, _ := json.Marshal(wrappedReq)
+	limit := defaultDepthLimit
+	if raw := c.Query("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+			return
+		}
+		limit = parsed
+	}
+
+	// 2. Ask the engine for the aggregated book. Depth is public, so no user is attached.
+	depthData := types.GetDepthData{Market: market, Limit: limit}
+	resp, err := sendToEngine(c.Request.Context(), uuid.Nil, "GET_DEPTH", depthData)
+	respondWithEngineResult(c, resp, err)
+}
 
-	// 4. Subscribe to the response channel BEFORE sending the command
-	pubsub := redisClient.Subscribe(ctx, responseChannel)
-	defer pubsub.Close()
+func GetBalances(c *gin.Context) {
+	userID, _ := c.Get("userID")
 
-	// 5. Push the command to the engine's queue
-	if err := redisClient.LPush(ctx, "messages", wrappedPayload).Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send order to engine"})
+	data := types.GetBalancesData{UserID: userID.(uuid.UUID)}
+	resp, err := sendToEngine(c.Request.Context(), userID.(uuid.UUID), "GET_BALANCES", data)
+	respondWithEngineResult(c, resp, err)
+}
+
+// OnRamp credits the caller's balance. It stands in for real deposits so that
+// accounts can be funded during development, and is only routed when
+// ENABLE_ONRAMP is set.
+func OnRamp(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	var req onRampRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !req.Amount.IsPositive() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "amount must be positive"})
+		return
+	}
+
+	data := types.OnRampData{
+		UserID: userID.(uuid.UUID),
+		Asset:  req.Asset,
+		Amount: req.Amount,
+	}
+	resp, err := sendToEngine(c.Request.Context(), userID.(uuid.UUID), "ON_RAMP", data)
+	respondWithEngineResult(c, resp, err)
+}
+
+// defaultFeeLevelRefresh is used when FEE_LEVEL_REFRESH is unset or invalid.
+const defaultFeeLevelRefresh = 5 * time.Minute
+
+// feeLevelRefresh reads how long a user's VIP level is reused before their
+// volume is summed again, e.g. "5m".
+func feeLevelRefresh() time.Duration {
+	refresh, err := time.ParseDuration(os.Getenv("FEE_LEVEL_REFRESH"))
+	if err != nil || refresh <= 0 {
+		return defaultFeeLevelRefresh
+	}
+	return refresh
+}
 
-	// 6. Wait for a response from the engine (with a timeout)
-	slog.Info("waiting for response on channel", "channel", responseChannel)
-	// In a real app, you would receive the engine's response here.
-	// For now, we'll just send a success message.
-	// _, err := pubsub.ReceiveMessage(ctx)
-	// if err != nil { ... }
+// cachedLevel is a user's VIP level and the volume it was worked out from.
+type cachedLevel struct {
+	level  int
+	volume decimal.Decimal
+	at     time.Time
+}
+
+// levelCache remembers each user's VIP level, so that placing an order does
+// not sum their 30-day trading volume every time.
+type levelCache struct {
+	mu      sync.Mutex
+	entries map[uuid.UUID]cachedLevel
+	volume  func(userID uuid.UUID, since time.Time) (decimal.Decimal, error)
+	now     func() time.Time
+}
+
+var feeLevels = &levelCache{
+	entries: make(map[uuid.UUID]cachedLevel),
+	volume:  database.TradingVolume,
+	now:     time.Now,
+}
+
+// feeLevel returns the user's VIP level and their trading volume over the last
+// 30 days, reading the volume again once the level is older than
+// FEE_LEVEL_REFRESH. If it cannot be read the user keeps the level they had,
+// or pays the base rates if there is none.
+func feeLevel(userID uuid.UUID) (int, decimal.Decimal) {
+	return feeLevels.get(userID)
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Order submitted successfully"})
+func (c *levelCache) get(userID uuid.UUID) (int, decimal.Decimal) {
+	if marketRegistry == nil {
+		return 0, decimal.Zero
+	}
+	now := c.now()
+	c.mu.Lock()
+	cached, ok := c.entries[userID]
+	c.mu.Unlock()
+	if ok && now.Sub(cached.at) < feeLevelRefresh() {
+		return cached.level, cached.volume
+	}
+
+	volume, err := c.volume(userID, now.Add(-database.VolumeWindow))
+	if err != nil {
+		slog.Error("could not read trading volume", "user_id", userID, "error", err)
+		return cached.level, cached.volume
+	}
+	cached = cachedLevel{level: marketRegistry.Level(volume), volume: volume, at: now}
+	c.mu.Lock()
+	c.entries[userID] = cached
+	c.mu.Unlock()
+	return cached.level, cached.volume
+}
+
+type marketFees struct {
+	Market string          `json:"market"`
+	Maker  decimal.Decimal `json:"maker"`
+	Taker  decimal.Decimal `json:"taker"`
+}
+
+// GetFees reports the caller's VIP level, the 30-day volume it is based on
+// and the maker and taker rates that level gets in each market.
+func GetFees(c *gin.Context) {
+	userID, _ := c.Get("userID")
+
+	level, volume := feeLevel(userID.(uuid.UUID))
+	fees := make([]marketFees, 0)
+	if marketRegistry != nil {
+		for _, m := range marketRegistry.All() {
+			rates := m.Rates(level)
+			fees = append(fees, marketFees{Market: m.Symbol, Maker: rates.Maker, Taker: rates.Taker})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"vip_level":  level,
+		"volume_30d": volume,
+		"fees":       fees,
+	})
 }
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Utsav7428/ChronoXchange/internal/bus"
+	"github.com/Utsav7428/ChronoXchange/internal/engine"
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// replier answers API requests over the bus and drops everything else.
+type replier struct{ b bus.Bus }
+
+func (r replier) Respond(clientID string, resp types.APIResponse) {
+	payload, _ := json.Marshal(resp)
+	r.b.Reply(context.Background(), clientID, payload)
+}
+func (replier) PushDB(interface{})        {}
+func (replier) PublishWS(types.WsMessage) {}
+
+func TestSendToEngineOverMemoryBus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := bus.NewMemory()
+	SetBus(b)
+	defer SetBus(nil)
+
+	// Run the engine the way cmd/engine does, minus Redis.
+	eng := engine.New(markets.Default(), replier{b})
+	commands, err := b.Consume(ctx, engineQueue, "engine", "engine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for ctx.Err() == nil {
+			msg, err := commands.Receive(ctx, time.Second)
+			if err != nil {
+				continue
+			}
+			var req engine.APIRequestWrapper
+			json.Unmarshal(msg.Data, &req)
+			req.DeliveryID = msg.ID
+			eng.Process(req)
+			commands.Ack(ctx, msg.ID)
+		}
+	}()
+
+	user := uuid.New()
+	resp, err := sendToEngine(ctx, user, "ON_RAMP", types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(250)})
+	if err != nil || !resp.Success {
+		t.Fatalf("on-ramp failed: %+v, %v", resp, err)
+	}
+	resp, err = sendToEngine(ctx, user, "GET_BALANCES", types.GetBalancesData{UserID: user})
+	if err != nil || !resp.Success {
+		t.Fatalf("balances failed: %+v, %v", resp, err)
+	}
+	if data, _ := json.Marshal(resp.Data); !strings.Contains(string(data), "250") {
+		t.Fatalf("balances do not show the on-ramp: %s", data)
+	}
+}
+
+func TestFeeLevelIsReadAgainOnlyOnceStale(t *testing.T) {
+	SetMarkets(markets.Default())
+	defer SetMarkets(nil)
+	t.Setenv("FEE_LEVEL_REFRESH", "1m")
+
+	now := time.Unix(0, 0)
+	reads := 0
+	cache := &levelCache{
+		entries: make(map[uuid.UUID]cachedLevel),
+		volume: func(uuid.UUID, time.Time) (decimal.Decimal, error) {
+			reads++
+			return decimal.NewFromInt(int64(reads * 1000)), nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	user := uuid.New()
+	for i := 0; i < 3; i++ {
+		if _, volume := cache.get(user); !volume.Equal(decimal.NewFromInt(1000)) || reads != 1 {
+			t.Fatalf("expected the first volume to be reused, got %s after %d reads", volume, reads)
+		}
+		now = now.Add(20 * time.Second)
+	}
+	if _, volume := cache.get(user); !volume.Equal(decimal.NewFromInt(2000)) || reads != 2 {
+		t.Fatalf("expected the volume to be read again once a minute old, got %s after %d reads", volume, reads)
+	}
+}
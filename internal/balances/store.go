@@ -0,0 +1,165 @@
+// Package balances keeps every user's available and locked funds per asset.
+// It lives inside the engine so that funds are checked and moved in the same
+// step as the matching that needs them.
+package balances
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/Utsav7428/ChronoXchange/internal/snapshot"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// CodeInsufficientFunds is the response code for orders the user cannot pay for.
+const CodeInsufficientFunds = "INSUFFICIENT_FUNDS"
+
+// FeeAccount is the exchange's own account, which collects trading fees.
+var FeeAccount = uuid.Nil
+
+// ErrInsufficientFunds is returned when a user's available balance cannot cover a lock.
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// Store holds balances keyed by user, then by asset.
+type Store struct {
+	mu       sync.Mutex
+	accounts map[uuid.UUID]map[string]*types.Balance
+}
+
+// NewStore creates an empty balance store.
+func NewStore() *Store {
+	return &Store{accounts: make(map[uuid.UUID]map[string]*types.Balance)}
+}
+
+// balance returns the user's balance of asset, creating an empty one if needed.
+func (s *Store) balance(user uuid.UUID, asset string) *types.Balance {
+	account, ok := s.accounts[user]
+	if !ok {
+		account = make(map[string]*types.Balance)
+		s.accounts[user] = account
+	}
+	b, ok := account[asset]
+	if !ok {
+		b = &types.Balance{}
+		account[asset] = b
+	}
+	return b
+}
+
+// Credit adds amount to the user's available balance.
+func (s *Store) Credit(user uuid.UUID, asset string, amount decimal.Decimal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.balance(user, asset)
+	b.Available = b.Available.Add(amount)
+}
+
+// Lock moves amount from available to locked, failing if not enough is available.
+func (s *Store) Lock(user uuid.UUID, asset string, amount decimal.Decimal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.balance(user, asset)
+	if b.Available.LessThan(amount) {
+		return ErrInsufficientFunds
+	}
+	b.Available = b.Available.Sub(amount)
+	b.Locked = b.Locked.Add(amount)
+	return nil
+}
+
+// Unlock moves amount from locked back to available.
+func (s *Store) Unlock(user uuid.UUID, asset string, amount decimal.Decimal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.balance(user, asset)
+	b.Locked = b.Locked.Sub(amount)
+	b.Available = b.Available.Add(amount)
+}
+
+// Spend removes amount from the user's locked balance, as a trade pays it away.
+func (s *Store) Spend(user uuid.UUID, asset string, amount decimal.Decimal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.balance(user, asset)
+	b.Locked = b.Locked.Sub(amount)
+}
+
+// Available returns the user's available balance of asset.
+func (s *Store) Available(user uuid.UUID, asset string) decimal.Decimal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if b, ok := s.accounts[user][asset]; ok {
+		return b.Available
+	}
+	return decimal.Zero
+}
+
+// Balances returns a copy of every balance the user holds, keyed by asset.
+func (s *Store) Balances(user uuid.UUID) map[string]types.Balance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[string]types.Balance, len(s.accounts[user]))
+	for asset, b := range s.accounts[user] {
+		out[asset] = *b
+	}
+	return out
+}
+
+// WriteSnapshot writes every balance, users and assets in sorted order.
+func (s *Store) WriteSnapshot(sw *snapshot.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]uuid.UUID, 0, len(s.accounts))
+	for user := range s.accounts {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].String() < users[j].String() })
+
+	sw.Uint32(uint32(len(users)))
+	for _, user := range users {
+		account := s.accounts[user]
+		assets := make([]string, 0, len(account))
+		for asset := range account {
+			assets = append(assets, asset)
+		}
+		sort.Strings(assets)
+
+		sw.UUID(user)
+		sw.Uint32(uint32(len(assets)))
+		for _, asset := range assets {
+			sw.String(asset)
+			sw.Decimal(account[asset].Available)
+			sw.Decimal(account[asset].Locked)
+		}
+	}
+}
+
+// ReadSnapshot replaces the store's balances with those written by WriteSnapshot.
+func (s *Store) ReadSnapshot(sr *snapshot.Reader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accounts = make(map[uuid.UUID]map[string]*types.Balance)
+	users := sr.Uint32()
+	for i := uint32(0); i < users && sr.Err() == nil; i++ {
+		user := sr.UUID()
+		assets := sr.Uint32()
+		for j := uint32(0); j < assets && sr.Err() == nil; j++ {
+			asset := sr.String()
+			b := s.balance(user, asset)
+			b.Available = sr.Decimal()
+			b.Locked = sr.Decimal()
+		}
+	}
+}
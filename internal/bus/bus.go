@@ -0,0 +1,126 @@
+// Package bus carries messages between the exchange's services: commands from
+// the API to the engine, engine output to the db-processor and the WebSocket
+// server, the engine's replies to the API and its journal to standby engines.
+//
+// Redis connects services running as separate processes. Memory does the same
+// within one process, for running the whole exchange as a single binary or in
+// tests without Redis.
+package bus
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNoMessage is returned by Consumer.Receive and Log.Read when no message arrived in time.
+	ErrNoMessage = errors.New("bus: no message")
+	// ErrFenced is returned by writes through a fenced bus once a newer
+	// fencing token has been taken for its key.
+	ErrFenced = errors.New("bus: another holder has the fencing token")
+)
+
+// Message is one message taken from a queue or a log.
+type Message struct {
+	// ID identifies the message within its queue or log. IDs increase in the
+	// order messages were added and have the form of Redis stream entry IDs,
+	// "<millis>-<seq>", whichever implementation assigned them.
+	ID   string
+	Data []byte
+}
+
+// Bus is everything the services need to talk to each other.
+type Bus interface {
+	Queue
+	Log
+	PubSub
+	RequestReply
+}
+
+// Queue is a set of named work queues. Every consumer group reading a queue
+// gets each message pushed onto it, and within a group each message goes to
+// one consumer, which acks it once handled. A message is kept until every
+// group has acked it. Delivery is at least once, so consumers must cope with
+// seeing a message again.
+type Queue interface {
+	// Push adds a message to the end of a queue.
+	Push(ctx context.Context, queue string, data []byte) error
+	// Consume reads a queue as the named consumer in a consumer group, creating
+	// the group if needed. A new group starts from the oldest message kept.
+	Consume(ctx context.Context, queue, group, consumer string) (Consumer, error)
+}
+
+// Consumer takes messages from a queue on behalf of one member of a consumer group.
+type Consumer interface {
+	// Receive returns the next message, waiting up to wait for one, or
+	// ErrNoMessage if none came. Messages this consumer was given before and
+	// never acked, say before a restart, come first.
+	Receive(ctx context.Context, wait time.Duration) (Message, error)
+	// Ack marks a message as handled, so that it is never delivered again.
+	Ack(ctx context.Context, id string) error
+	// Reclaim takes over every message that any consumer in the group has held
+	// without acking for at least minIdle, and returns how many there were.
+	// Receive delivers them, and this consumer's other unacked messages, next.
+	Reclaim(ctx context.Context, minIdle time.Duration) (int, error)
+}
+
+// Log is a set of named append-only logs, each read in full by any number of
+// readers keeping their own position, such as the engine's journal followed
+// by standbys. Nothing is acked; a log only loses its oldest entries when it
+// is trimmed, and a reader that far behind misses them.
+type Log interface {
+	// Append adds an entry to the end of a log, trimming the log to about
+	// maxLen entries, or not at all if maxLen is zero.
+	Append(ctx context.Context, log string, maxLen int64, data []byte) error
+	// Read returns up to count entries that come after the entry with ID
+	// after, or from the start of the log if after is "0". If there are none
+	// it waits up to wait for one, or not at all if wait is zero or less, and
+	// then returns ErrNoMessage.
+	Read(ctx context.Context, log, after string, count int, wait time.Duration) ([]Message, error)
+}
+
+// Fencing makes sure that of several writers taking turns, such as a primary
+// engine and the standby that replaces it, only the latest one can write.
+type Fencing interface {
+	// TakeToken takes a new fencing token for key, greater than any taken
+	// before, and so fences off every holder of an older one.
+	TakeToken(ctx context.Context, key string) (int64, error)
+	// ClaimToken takes a new token like TakeToken, but only if the last one
+	// taken for key is held, or if none has been and held is zero. Otherwise
+	// it fails with ErrFenced, as a newer holder must not be fenced off by mistake.
+	ClaimToken(ctx context.Context, key string, held int64) (int64, error)
+	// Fenced returns a bus whose pushes, appends, publishes and replies only
+	// happen while the last token taken for key is the one token returns at
+	// the time of the write. Otherwise they fail with ErrFenced.
+	Fenced(key string, token func() int64) Bus
+}
+
+// PubSub broadcasts events to whoever is subscribed when they are published.
+// Nothing is kept for subscribers that come later.
+type PubSub interface {
+	// Publish sends an event to every current subscriber of a topic.
+	Publish(ctx context.Context, topic string, data []byte) error
+	// Subscribe starts receiving a topic's events. It returns once the
+	// subscription is in place, so nothing published afterwards is missed.
+	Subscribe(ctx context.Context, topic string) (Subscription, error)
+}
+
+// Subscription is a live subscription to a topic.
+type Subscription interface {
+	// Messages returns the channel events arrive on. It is closed by Close.
+	Messages() <-chan []byte
+	// Close ends the subscription.
+	Close() error
+}
+
+// RequestReply sends a request through a queue and waits for the one reply
+// to it, sent by whichever consumer handles the request.
+type RequestReply interface {
+	// Request pushes a request onto a queue and waits for its reply until ctx
+	// is done. newRequest builds the request given the address its handler
+	// must send the reply to.
+	Request(ctx context.Context, queue string, newRequest func(replyTo string) ([]byte, error)) ([]byte, error)
+	// Reply answers a request. A reply nobody is waiting for any more is dropped.
+	Reply(ctx context.Context, replyTo string, data []byte) error
+}
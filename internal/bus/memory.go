@@ -0,0 +1,486 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// subscriptionBuffer is how many events a subscriber can fall behind by
+// before Memory starts dropping events for it, as Redis does for a slow client.
+const subscriptionBuffer = 1024
+
+// Memory is a Bus for services running in one process. Nothing survives the
+// process, so it suits a single binary or tests, not a restartable deployment.
+type Memory struct {
+	mu      sync.Mutex
+	queues  map[string]*memQueue
+	logs    map[string]*memQueue
+	topics  map[string]map[*memSubscription]struct{}
+	replies map[string]chan []byte
+	tokens  map[string]int64 // Last fencing token taken for each key
+	now     func() time.Time
+}
+
+// NewMemory returns an empty in-process bus.
+func NewMemory() *Memory {
+	return &Memory{
+		queues:  make(map[string]*memQueue),
+		logs:    make(map[string]*memQueue),
+		topics:  make(map[string]map[*memSubscription]struct{}),
+		replies: make(map[string]chan []byte),
+		tokens:  make(map[string]int64),
+		now:     time.Now,
+	}
+}
+
+// memQueue keeps a queue's messages until every group has had them delivered,
+// or a log's until it is trimmed.
+type memQueue struct {
+	log    []memEntry // Messages kept, oldest first
+	base   int        // Position of log[0] among every message ever pushed
+	groups map[string]*memGroup
+	millis int64         // Millisecond part of the last ID assigned
+	seq    int64         // Sequence part of the last ID assigned
+	pushed chan struct{} // Closed, and replaced, whenever a message is pushed
+}
+
+type memEntry struct {
+	pos int
+	msg Message
+}
+
+// memGroup tracks one consumer group's progress through a queue.
+type memGroup struct {
+	next    int // Position of the next message to deliver
+	pending map[string]*memPending
+}
+
+// memPending is a message delivered to a consumer and not yet acked.
+type memPending struct {
+	entry    memEntry
+	consumer string
+	since    time.Time
+}
+
+func (m *Memory) queue(name string) *memQueue {
+	return stream(m.queues, name)
+}
+
+func (m *Memory) log(name string) *memQueue {
+	return stream(m.logs, name)
+}
+
+func stream(streams map[string]*memQueue, name string) *memQueue {
+	q, ok := streams[name]
+	if !ok {
+		q = &memQueue{groups: make(map[string]*memGroup), pushed: make(chan struct{})}
+		streams[name] = q
+	}
+	return q
+}
+
+// add appends a message at time now, giving it the next ID.
+func (q *memQueue) add(now time.Time, data []byte) {
+	// IDs follow the clock like Redis stream IDs, and never go backwards.
+	millis := now.UnixMilli()
+	if millis > q.millis {
+		q.millis, q.seq = millis, 0
+	} else {
+		q.seq++
+	}
+	id := fmt.Sprintf("%d-%d", q.millis, q.seq)
+
+	q.log = append(q.log, memEntry{pos: q.base + len(q.log), msg: Message{ID: id, Data: data}})
+	close(q.pushed)
+	q.pushed = make(chan struct{})
+}
+
+// Push adds a message to the end of a queue.
+func (m *Memory) Push(ctx context.Context, queue string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.push(queue, data)
+}
+
+// push does the work of Push. The caller holds m.mu.
+func (m *Memory) push(queue string, data []byte) error {
+	m.queue(queue).add(m.now(), data)
+	return nil
+}
+
+// Consume reads a queue as the named consumer in a consumer group.
+func (m *Memory) Consume(ctx context.Context, queue, group, consumer string) (Consumer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queue(queue)
+	g, ok := q.groups[group]
+	if !ok {
+		g = &memGroup{next: q.base, pending: make(map[string]*memPending)}
+		q.groups[group] = g
+	}
+	c := &memConsumer{m: m, q: q, g: g, name: consumer}
+	c.redeliverOwn()
+	return c, nil
+}
+
+// trim drops the messages every group has had delivered.
+func (q *memQueue) trim() {
+	done := q.base + len(q.log)
+	for _, g := range q.groups {
+		done = min(done, g.next)
+	}
+	if n := done - q.base; n > 0 {
+		q.log = append([]memEntry(nil), q.log[n:]...)
+		q.base = done
+	}
+}
+
+// memConsumer is one member of a consumer group on a Memory queue.
+type memConsumer struct {
+	m    *Memory
+	q    *memQueue
+	g    *memGroup
+	name string
+
+	redeliver []string // IDs of this consumer's unacked messages to hand out again
+}
+
+// redeliverOwn queues up this consumer's unacked messages, oldest first, to be
+// handed out before anything new. The caller holds c.m.mu.
+func (c *memConsumer) redeliverOwn() {
+	var own []*memPending
+	for _, p := range c.g.pending {
+		if p.consumer == c.name {
+			own = append(own, p)
+		}
+	}
+	sort.Slice(own, func(i, j int) bool { return own[i].entry.pos < own[j].entry.pos })
+
+	c.redeliver = c.redeliver[:0]
+	for _, p := range own {
+		c.redeliver = append(c.redeliver, p.entry.msg.ID)
+	}
+}
+
+// Receive returns the next message, waiting up to wait for one.
+func (c *memConsumer) Receive(ctx context.Context, wait time.Duration) (Message, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		msg, pushed, ok := c.take()
+		if ok {
+			return msg, nil
+		}
+		select {
+		case <-pushed:
+		case <-timer.C:
+			return Message{}, ErrNoMessage
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+	}
+}
+
+// take hands out the next message if there is one, and otherwise returns the
+// channel that is closed when one is pushed.
+func (c *memConsumer) take() (Message, <-chan struct{}, bool) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+
+	for len(c.redeliver) > 0 {
+		id := c.redeliver[0]
+		c.redeliver = c.redeliver[1:]
+		// Skip messages acked, or claimed by another consumer, since.
+		if p, ok := c.g.pending[id]; ok && p.consumer == c.name {
+			p.since = c.m.now()
+			return p.entry.msg, nil, true
+		}
+	}
+
+	if c.g.next >= c.q.base+len(c.q.log) {
+		return Message{}, c.q.pushed, false
+	}
+	entry := c.q.log[c.g.next-c.q.base]
+	c.g.next++
+	c.g.pending[entry.msg.ID] = &memPending{entry: entry, consumer: c.name, since: c.m.now()}
+	c.q.trim()
+	return entry.msg, nil, true
+}
+
+// Ack marks a message as handled.
+func (c *memConsumer) Ack(ctx context.Context, id string) error {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	delete(c.g.pending, id)
+	return nil
+}
+
+// Reclaim takes over messages the group has held unacked for at least minIdle.
+func (c *memConsumer) Reclaim(ctx context.Context, minIdle time.Duration) (int, error) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	now := c.m.now()
+	claimed := 0
+	for _, p := range c.g.pending {
+		if now.Sub(p.since) >= minIdle {
+			p.consumer, p.since = c.name, now
+			claimed++
+		}
+	}
+	c.redeliverOwn()
+	return claimed, nil
+}
+
+// Append adds an entry to the end of a log.
+func (m *Memory) Append(ctx context.Context, log string, maxLen int64, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.append(log, maxLen, data)
+}
+
+// append does the work of Append. The caller holds m.mu.
+func (m *Memory) append(log string, maxLen int64, data []byte) error {
+	q := m.log(log)
+	q.add(m.now(), data)
+	if n := len(q.log) - int(maxLen); maxLen > 0 && n > 0 {
+		q.log = append([]memEntry(nil), q.log[n:]...)
+		q.base += n
+	}
+	return nil
+}
+
+// Read returns up to count entries of a log after the entry with ID after.
+func (m *Memory) Read(ctx context.Context, log, after string, count int, wait time.Duration) ([]Message, error) {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		msgs, pushed := m.read(log, after, count)
+		if len(msgs) > 0 {
+			return msgs, nil
+		}
+		if timeout == nil {
+			return nil, ErrNoMessage
+		}
+		select {
+		case <-pushed:
+		case <-timeout:
+			return nil, ErrNoMessage
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// read returns the entries Read would, and the channel that is closed when
+// another is appended.
+func (m *Memory) read(log, after string, count int) ([]Message, <-chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.log(log)
+	first := sort.Search(len(q.log), func(i int) bool { return idAfter(q.log[i].msg.ID, after) })
+	var msgs []Message
+	for _, entry := range q.log[first:] {
+		if count > 0 && len(msgs) == count {
+			break
+		}
+		msgs = append(msgs, entry.msg)
+	}
+	return msgs, q.pushed
+}
+
+// idAfter reports whether message ID id comes after after. IDs compare as
+// Redis stream entry IDs, in which "0" comes before every other.
+func idAfter(id, after string) bool {
+	idMillis, idSeq := parseID(id)
+	afterMillis, afterSeq := parseID(after)
+	return idMillis > afterMillis || (idMillis == afterMillis && idSeq > afterSeq)
+}
+
+func parseID(id string) (uint64, uint64) {
+	millis, seq, _ := strings.Cut(id, "-")
+	m, _ := strconv.ParseUint(millis, 10, 64)
+	n, _ := strconv.ParseUint(seq, 10, 64)
+	return m, n
+}
+
+// Publish sends an event to every current subscriber of a topic. A subscriber
+// too far behind to take it misses it.
+func (m *Memory) Publish(ctx context.Context, topic string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.publish(topic, data)
+}
+
+// publish does the work of Publish. The caller holds m.mu.
+func (m *Memory) publish(topic string, data []byte) error {
+	for sub := range m.topics[topic] {
+		select {
+		case sub.ch <- data:
+		default:
+			slog.Warn("subscriber is too slow, dropping event", "topic", topic)
+		}
+	}
+	return nil
+}
+
+// Subscribe starts receiving a topic's events.
+func (m *Memory) Subscribe(ctx context.Context, topic string) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sub := &memSubscription{m: m, topic: topic, ch: make(chan []byte, subscriptionBuffer)}
+	if m.topics[topic] == nil {
+		m.topics[topic] = make(map[*memSubscription]struct{})
+	}
+	m.topics[topic][sub] = struct{}{}
+	return sub, nil
+}
+
+type memSubscription struct {
+	m     *Memory
+	topic string
+	ch    chan []byte
+}
+
+func (s *memSubscription) Messages() <-chan []byte {
+	return s.ch
+}
+
+func (s *memSubscription) Close() error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	subs := s.m.topics[s.topic]
+	if _, ok := subs[s]; !ok {
+		return nil
+	}
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(s.m.topics, s.topic)
+	}
+	close(s.ch)
+	return nil
+}
+
+// Request pushes a request onto a queue and waits for its reply.
+func (m *Memory) Request(ctx context.Context, queue string, newRequest func(replyTo string) ([]byte, error)) ([]byte, error) {
+	return m.request(ctx, queue, newRequest, m.Push)
+}
+
+// request does the work of Request, pushing the request with push.
+func (m *Memory) request(ctx context.Context, queue string, newRequest func(replyTo string) ([]byte, error), push func(context.Context, string, []byte) error) ([]byte, error) {
+	replyTo := uuid.NewString()
+	reply := make(chan []byte, 1)
+	m.mu.Lock()
+	m.replies[replyTo] = reply
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.replies, replyTo)
+		m.mu.Unlock()
+	}()
+
+	data, err := newRequest(replyTo)
+	if err != nil {
+		return nil, err
+	}
+	if err := push(ctx, queue, data); err != nil {
+		return nil, err
+	}
+	select {
+	case data := <-reply:
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Reply answers a request.
+func (m *Memory) Reply(ctx context.Context, replyTo string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reply(replyTo, data)
+}
+
+// reply does the work of Reply. The caller holds m.mu.
+func (m *Memory) reply(replyTo string, data []byte) error {
+	if reply, ok := m.replies[replyTo]; ok {
+		select {
+		case reply <- data:
+		default: // Already answered
+		}
+	}
+	return nil
+}
+
+// TakeToken takes a new fencing token for key.
+func (m *Memory) TakeToken(ctx context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[key]++
+	return m.tokens[key], nil
+}
+
+// ClaimToken takes a new fencing token for key if the last one is held.
+func (m *Memory) ClaimToken(ctx context.Context, key string, held int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens[key] != held {
+		return 0, ErrFenced
+	}
+	m.tokens[key]++
+	return m.tokens[key], nil
+}
+
+// Fenced returns a bus whose writes only happen while the last token taken
+// for key is the one token returns. Otherwise they fail with ErrFenced.
+func (m *Memory) Fenced(key string, token func() int64) Bus {
+	return &memFenced{Memory: m, key: key, token: token}
+}
+
+// memFenced is a Memory bus whose writes are fenced; reads go straight through.
+type memFenced struct {
+	*Memory
+	key   string
+	token func() int64
+}
+
+// write makes a write while holding the lock, if the caller's token is current.
+func (f *memFenced) write(do func() error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if current := f.tokens[f.key]; current == 0 || current != f.token() {
+		return ErrFenced
+	}
+	return do()
+}
+
+func (f *memFenced) Push(ctx context.Context, queue string, data []byte) error {
+	return f.write(func() error { return f.push(queue, data) })
+}
+
+func (f *memFenced) Append(ctx context.Context, log string, maxLen int64, data []byte) error {
+	return f.write(func() error { return f.append(log, maxLen, data) })
+}
+
+func (f *memFenced) Publish(ctx context.Context, topic string, data []byte) error {
+	return f.write(func() error { return f.publish(topic, data) })
+}
+
+func (f *memFenced) Request(ctx context.Context, queue string, newRequest func(replyTo string) ([]byte, error)) ([]byte, error) {
+	return f.request(ctx, queue, newRequest, f.Push)
+}
+
+func (f *memFenced) Reply(ctx context.Context, replyTo string, data []byte) error {
+	return f.write(func() error { return f.reply(replyTo, data) })
+}
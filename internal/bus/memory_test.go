@@ -0,0 +1,231 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, c Consumer) Message {
+	t.Helper()
+	msg, err := c.Receive(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func push(t *testing.T, b Bus, queue string, data ...string) {
+	t.Helper()
+	for _, d := range data {
+		if err := b.Push(context.Background(), queue, []byte(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEveryGroupGetsEveryMessageOnce(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+	push(t, b, "q", "one", "two")
+
+	engine, _ := b.Consume(ctx, "q", "engine", "a")
+	other, _ := b.Consume(ctx, "q", "engine", "b")
+	audit, _ := b.Consume(ctx, "q", "audit", "a")
+
+	first, second := receive(t, engine), receive(t, other)
+	if string(first.Data) != "one" || string(second.Data) != "two" {
+		t.Fatalf("group members got %q and %q", first.Data, second.Data)
+	}
+	if first.ID >= second.ID {
+		t.Fatalf("IDs do not increase: %s then %s", first.ID, second.ID)
+	}
+	for _, want := range []string{"one", "two"} {
+		if got := receive(t, audit); string(got.Data) != want {
+			t.Fatalf("second group got %q, want %q", got.Data, want)
+		}
+	}
+	if _, err := engine.Receive(ctx, 10*time.Millisecond); !errors.Is(err, ErrNoMessage) {
+		t.Fatalf("expected ErrNoMessage, got %v", err)
+	}
+}
+
+func TestReceiveWaitsForAPush(t *testing.T) {
+	b := NewMemory()
+	c, _ := b.Consume(context.Background(), "q", "g", "c")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Push(context.Background(), "q", []byte("late"))
+	}()
+	if got := receive(t, c); string(got.Data) != "late" {
+		t.Fatalf("got %q", got.Data)
+	}
+}
+
+func TestUnackedMessagesAreDeliveredAgain(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+	push(t, b, "q", "one", "two", "three")
+
+	c, _ := b.Consume(ctx, "q", "g", "engine")
+	one, two := receive(t, c), receive(t, c)
+	c.Ack(ctx, one.ID)
+
+	// A restarted consumer gets what it left unacked before anything new.
+	c, _ = b.Consume(ctx, "q", "g", "engine")
+	if got := receive(t, c); got.ID != two.ID {
+		t.Fatalf("after restart got %q, want %q", got.Data, two.Data)
+	}
+	if got := receive(t, c); string(got.Data) != "three" {
+		t.Fatalf("got %q, want three", got.Data)
+	}
+
+	// Another consumer takes over both once they have been idle long enough.
+	other, _ := b.Consume(ctx, "q", "g", "standby")
+	if n, _ := other.Reclaim(ctx, time.Hour); n != 0 {
+		t.Fatalf("reclaimed %d messages that were not idle", n)
+	}
+	if n, _ := other.Reclaim(ctx, 0); n != 2 {
+		t.Fatalf("reclaimed %d messages, want 2", n)
+	}
+	for _, want := range []string{"two", "three"} {
+		msg := receive(t, other)
+		if string(msg.Data) != want {
+			t.Fatalf("reclaimed %q, want %q", msg.Data, want)
+		}
+		other.Ack(ctx, msg.ID)
+	}
+	// The consumer they were taken from no longer gets them.
+	c, _ = b.Consume(ctx, "q", "g", "engine")
+	if _, err := c.Receive(ctx, 10*time.Millisecond); !errors.Is(err, ErrNoMessage) {
+		t.Fatalf("expected ErrNoMessage, got %v", err)
+	}
+}
+
+func TestPublishReachesCurrentSubscribers(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+	b.Publish(ctx, "ws", []byte("before"))
+
+	first, _ := b.Subscribe(ctx, "ws")
+	second, _ := b.Subscribe(ctx, "ws")
+	b.Publish(ctx, "ws", []byte("fill"))
+	for _, sub := range []Subscription{first, second} {
+		if got := string(<-sub.Messages()); got != "fill" {
+			t.Fatalf("subscriber got %q, want fill", got)
+		}
+	}
+
+	second.Close()
+	if _, ok := <-second.Messages(); ok {
+		t.Fatal("closed subscription still open")
+	}
+	b.Publish(ctx, "ws", []byte("after"))
+	if got := string(<-first.Messages()); got != "after" {
+		t.Fatalf("subscriber got %q, want after", got)
+	}
+}
+
+func TestRequestGetsItsReply(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+	server, _ := b.Consume(ctx, "engine", "engine", "engine")
+	go func() {
+		msg, err := server.Receive(ctx, time.Second)
+		if err != nil {
+			return
+		}
+		// The request is its own reply address here.
+		b.Reply(ctx, string(msg.Data), []byte("ok"))
+		server.Ack(ctx, msg.ID)
+	}()
+
+	reply, err := b.Request(ctx, "engine", func(replyTo string) ([]byte, error) {
+		return []byte(replyTo), nil
+	})
+	if err != nil || string(reply) != "ok" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+
+	// Nobody answers this one.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = b.Request(ctx, "engine", func(replyTo string) ([]byte, error) {
+		return []byte(replyTo), nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func TestEveryReaderGetsTheWholeLog(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+	for _, d := range []string{"one", "two", "three"} {
+		if err := b.Append(ctx, "journal", 2, []byte(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The log was trimmed to its last two entries.
+	msgs, err := b.Read(ctx, "journal", "0", 10, 0)
+	if err != nil || len(msgs) != 2 || string(msgs[0].Data) != "two" || string(msgs[1].Data) != "three" {
+		t.Fatalf("read %+v, %v", msgs, err)
+	}
+	// Reading is not consuming: another reader, or the same one, can read them again.
+	again, _ := b.Read(ctx, "journal", "0", 1, 0)
+	if len(again) != 1 || again[0].ID != msgs[0].ID {
+		t.Fatalf("read %+v again, want %+v", again, msgs[:1])
+	}
+	if _, err := b.Read(ctx, "journal", msgs[1].ID, 10, 0); !errors.Is(err, ErrNoMessage) {
+		t.Fatalf("expected ErrNoMessage at the end of the log, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Append(ctx, "journal", 0, []byte("late"))
+	}()
+	late, err := b.Read(ctx, "journal", msgs[1].ID, 10, time.Second)
+	if err != nil || len(late) != 1 || string(late[0].Data) != "late" {
+		t.Fatalf("read %+v, %v", late, err)
+	}
+}
+
+func TestFencedWritesStopOnceANewerTokenIsTaken(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+	var held int64
+	fenced := b.Fenced("epoch", func() int64 { return held })
+
+	if err := fenced.Append(ctx, "journal", 0, []byte("none")); !errors.Is(err, ErrFenced) {
+		t.Fatalf("expected a write without a token to be fenced, got %v", err)
+	}
+	held, _ = b.TakeToken(ctx, "epoch")
+	if err := fenced.Append(ctx, "journal", 0, []byte("primary")); err != nil {
+		t.Fatal(err)
+	}
+	sub, _ := b.Subscribe(ctx, "ws")
+	if err := fenced.Publish(ctx, "ws", []byte("fill")); err != nil {
+		t.Fatal(err)
+	}
+	<-sub.Messages()
+
+	// A standby takes over.
+	if next, _ := b.TakeToken(ctx, "epoch"); next <= held {
+		t.Fatalf("token %d does not follow %d", next, held)
+	}
+	for name, write := range map[string]func() error{
+		"push":    func() error { return fenced.Push(ctx, "db", []byte("x")) },
+		"append":  func() error { return fenced.Append(ctx, "journal", 0, []byte("x")) },
+		"publish": func() error { return fenced.Publish(ctx, "ws", []byte("x")) },
+		"reply":   func() error { return fenced.Reply(ctx, "client", []byte("x")) },
+	} {
+		if err := write(); !errors.Is(err, ErrFenced) {
+			t.Errorf("expected %s to be fenced, got %v", name, err)
+		}
+	}
+	if msgs, _ := b.Read(ctx, "journal", "0", 10, 0); len(msgs) != 1 {
+		t.Fatalf("expected only the write made with the current token, got %+v", msgs)
+	}
+}
@@ -0,0 +1,362 @@
+package bus
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// fencedScript performs a write only if the caller still holds the current
+// fencing token, so that a writer that has been replaced can never write
+// alongside the one that replaced it, however late it notices.
+//
+// ARGV is the token, then either PUBLISH and the payload, or XADD, the
+// stream's approximate maximum length (0 for none) and the entry's fields.
+var fencedScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if ARGV[2] == 'PUBLISH' then
+	redis.call('PUBLISH', KEYS[2], ARGV[3])
+elseif ARGV[3] == '0' then
+	redis.call('XADD', KEYS[2], '*', unpack(ARGV, 4))
+else
+	redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[3], '*', unpack(ARGV, 4))
+end
+return 1
+`)
+
+// claimScript takes a new fencing token only if KEYS[1] holds ARGV[1], the
+// caller's last token, or nothing at all. It returns the new token, or 0.
+var claimScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current and current ~= ARGV[1] then
+	return 0
+end
+return redis.call('INCR', KEYS[1])
+`)
+
+// trimEvery is how many messages a consumer acks between trims of its queue.
+const trimEvery = 1000
+
+// Redis is a Bus for services running as separate processes. Queues and logs
+// are streams whose entries carry the message in their "data" field, queues
+// read through consumer groups; topics and replies are pub/sub channels.
+// Fencing tokens are counters, incremented to take a new one.
+type Redis struct {
+	rdb      *redis.Client
+	fenceKey string       // Empty unless writes are fenced
+	token    func() int64 // The caller's current fencing token
+}
+
+// NewRedis returns a bus on an existing client.
+func NewRedis(rdb *redis.Client) *Redis {
+	return &Redis{rdb: rdb}
+}
+
+// DialRedis connects to the Redis server at url, as given by REDIS_URL.
+func DialRedis(url string) (*Redis, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewRedis(redis.NewClient(opts)), nil
+}
+
+// TakeToken increments the counter at key and returns its new value.
+func (r *Redis) TakeToken(ctx context.Context, key string) (int64, error) {
+	return r.rdb.Incr(ctx, key).Result()
+}
+
+// ClaimToken increments the counter at key if it is still held, or absent.
+func (r *Redis) ClaimToken(ctx context.Context, key string, held int64) (int64, error) {
+	token, err := claimScript.Run(ctx, r.rdb, []string{key}, held).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if token == 0 {
+		return 0, ErrFenced
+	}
+	return token, nil
+}
+
+// Fenced returns a bus on the same client whose pushes, appends, publishes
+// and replies only happen while the value at key is still the caller's token,
+// as returned by token at the time of the write. Otherwise they fail with ErrFenced.
+func (r *Redis) Fenced(key string, token func() int64) Bus {
+	return &Redis{rdb: r.rdb, fenceKey: key, token: token}
+}
+
+// xadd adds an entry with the given field/value pairs to a stream, trimming
+// it to about maxLen entries, or not at all if maxLen is zero.
+func (r *Redis) xadd(ctx context.Context, stream string, maxLen int64, fields ...interface{}) error {
+	if r.fenceKey != "" {
+		return r.fenced(ctx, "XADD", stream, append([]interface{}{maxLen}, fields...)...)
+	}
+	return r.rdb.XAdd(ctx, &redis.XAddArgs{Stream: stream, MaxLen: maxLen, Approx: maxLen > 0, Values: fields}).Err()
+}
+
+func (r *Redis) publish(ctx context.Context, channel string, data []byte) error {
+	if r.fenceKey != "" {
+		return r.fenced(ctx, "PUBLISH", channel, string(data))
+	}
+	return r.rdb.Publish(ctx, channel, data).Err()
+}
+
+func (r *Redis) fenced(ctx context.Context, op, key string, args ...interface{}) error {
+	args = append([]interface{}{r.token(), op}, args...)
+	ok, err := fencedScript.Run(ctx, r.rdb, []string{r.fenceKey, key}, args...).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrFenced
+	}
+	return nil
+}
+
+// Push adds a message to the end of a queue.
+func (r *Redis) Push(ctx context.Context, queue string, data []byte) error {
+	return r.xadd(ctx, queue, 0, "data", string(data))
+}
+
+// Consume reads a queue as the named consumer in a consumer group, creating
+// the stream and the group if they do not exist yet.
+func (r *Redis) Consume(ctx context.Context, queue, group, consumer string) (Consumer, error) {
+	err := r.rdb.XGroupCreateMkStream(ctx, queue, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+	return &redisConsumer{rdb: r.rdb, stream: queue, group: group, name: consumer, pendingFrom: "0"}, nil
+}
+
+// redisConsumer reads a stream through a consumer group. It starts by reading
+// back its own pending entries, then moves on to new ones.
+type redisConsumer struct {
+	rdb                 *redis.Client
+	stream, group, name string
+
+	pendingFrom string           // Where to read pending entries from; empty once they are done
+	buffered    []redis.XMessage // Pending entries read but not yet handed out
+	acks        int              // Messages acked, to trim the stream every trimEvery
+}
+
+// Receive returns the next message, waiting up to wait for one.
+func (c *redisConsumer) Receive(ctx context.Context, wait time.Duration) (Message, error) {
+	for len(c.buffered) == 0 {
+		id, block := ">", wait
+		if c.pendingFrom != "" {
+			id, block = c.pendingFrom, -1
+		}
+		streams, err := c.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.group,
+			Consumer: c.name,
+			Streams:  []string{c.stream, id},
+			Count:    100,
+			Block:    block,
+		}).Result()
+		if err == redis.Nil {
+			return Message{}, ErrNoMessage
+		}
+		if err != nil {
+			return Message{}, err
+		}
+		msgs := streams[0].Messages
+		if c.pendingFrom != "" {
+			if len(msgs) == 0 {
+				c.pendingFrom = ""
+				continue
+			}
+			c.pendingFrom = msgs[len(msgs)-1].ID
+		}
+		c.buffered = msgs
+	}
+
+	msg := c.buffered[0]
+	c.buffered = c.buffered[1:]
+	data, _ := msg.Values["data"].(string)
+	return Message{ID: msg.ID, Data: []byte(data)}, nil
+}
+
+// Ack marks a message as handled by this consumer's group. The entry stays in
+// the stream for other groups; every trimEvery acks the consumer trims the
+// entries all groups are done with.
+func (c *redisConsumer) Ack(ctx context.Context, id string) error {
+	if err := c.rdb.XAck(ctx, c.stream, c.group, id).Err(); err != nil {
+		return err
+	}
+	c.acks++
+	if c.acks%trimEvery == 0 {
+		// An untrimmed stream only takes more memory until the next try.
+		if err := c.trim(ctx); err != nil {
+			slog.Warn("could not trim queue", "queue", c.stream, "error", err)
+		}
+	}
+	return nil
+}
+
+// trim removes the entries at the start of the stream that every group has
+// been delivered and acked, as Memory does. Entries still pending in any
+// group are kept, so that they can be reclaimed.
+func (c *redisConsumer) trim(ctx context.Context) error {
+	groups, err := c.rdb.XInfoGroups(ctx, c.stream).Result()
+	if err != nil {
+		return err
+	}
+	minID := ""
+	for _, g := range groups {
+		keep := g.LastDeliveredID
+		if g.Pending > 0 {
+			pending, err := c.rdb.XPending(ctx, c.stream, g.Name).Result()
+			if err != nil {
+				return err
+			}
+			keep = pending.Lower
+		}
+		if minID == "" || idAfter(minID, keep) {
+			minID = keep
+		}
+	}
+	if minID == "" {
+		return nil
+	}
+	return c.rdb.XTrimMinIDApprox(ctx, c.stream, minID, 0).Err()
+}
+
+// Reclaim takes over entries the group has held unacked for at least minIdle.
+func (c *redisConsumer) Reclaim(ctx context.Context, minIdle time.Duration) (int, error) {
+	claimed := 0
+	start := "0-0"
+	for {
+		ids, next, err := c.rdb.XAutoClaimJustID(ctx, &redis.XAutoClaimArgs{
+			Stream:   c.stream,
+			Group:    c.group,
+			Consumer: c.name,
+			MinIdle:  minIdle,
+			Start:    start,
+			Count:    100,
+		}).Result()
+		if err != nil {
+			return claimed, err
+		}
+		claimed += len(ids)
+		if next == "0-0" {
+			break
+		}
+		start = next
+	}
+	// Read the claimed entries back with the rest of this consumer's pending ones.
+	c.pendingFrom, c.buffered = "0", nil
+	return claimed, nil
+}
+
+// Append adds an entry to the end of a log.
+func (r *Redis) Append(ctx context.Context, log string, maxLen int64, data []byte) error {
+	return r.xadd(ctx, log, maxLen, "data", string(data))
+}
+
+// Read returns up to count entries of a log after the entry with ID after.
+func (r *Redis) Read(ctx context.Context, log, after string, count int, wait time.Duration) ([]Message, error) {
+	if wait <= 0 {
+		wait = -1 // Zero would block forever
+	}
+	streams, err := r.rdb.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{log, after},
+		Count:   int64(count),
+		Block:   wait,
+	}).Result()
+	if err == redis.Nil {
+		return nil, ErrNoMessage
+	}
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]Message, 0, len(streams[0].Messages))
+	for _, msg := range streams[0].Messages {
+		data, _ := msg.Values["data"].(string)
+		msgs = append(msgs, Message{ID: msg.ID, Data: []byte(data)})
+	}
+	if len(msgs) == 0 {
+		return nil, ErrNoMessage
+	}
+	return msgs, nil
+}
+
+// Publish sends an event to every current subscriber of a topic.
+func (r *Redis) Publish(ctx context.Context, topic string, data []byte) error {
+	return r.publish(ctx, topic, data)
+}
+
+// Subscribe starts receiving a topic's events.
+func (r *Redis) Subscribe(ctx context.Context, topic string) (Subscription, error) {
+	ps := r.rdb.Subscribe(ctx, topic)
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return nil, err
+	}
+	sub := &redisSubscription{ps: ps, ch: make(chan []byte), done: make(chan struct{})}
+	go func() {
+		defer close(sub.ch)
+		for msg := range ps.Channel() {
+			select {
+			case sub.ch <- []byte(msg.Payload):
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+type redisSubscription struct {
+	ps   *redis.PubSub
+	ch   chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func (s *redisSubscription) Messages() <-chan []byte {
+	return s.ch
+}
+
+func (s *redisSubscription) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return s.ps.Close()
+}
+
+// Request pushes a request onto a queue and waits for its reply on a channel
+// of its own, subscribed to before the request is pushed so it cannot be missed.
+func (r *Redis) Request(ctx context.Context, queue string, newRequest func(replyTo string) ([]byte, error)) ([]byte, error) {
+	replyTo := uuid.NewString()
+	ps := r.rdb.Subscribe(ctx, replyTo)
+	defer ps.Close()
+	if _, err := ps.Receive(ctx); err != nil {
+		return nil, err
+	}
+
+	data, err := newRequest(replyTo)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Push(ctx, queue, data); err != nil {
+		return nil, err
+	}
+	msg, err := ps.ReceiveMessage(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return []byte(msg.Payload), nil
+}
+
+// Reply answers a request.
+func (r *Redis) Reply(ctx context.Context, replyTo string, data []byte) error {
+	return r.publish(ctx, replyTo, data)
+}
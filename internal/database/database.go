@@ -36,7 +36,7 @@ func Connect() {
 
 	// Run database migrations to create the tables.
 	// This ensures your schema is up-to-date every time the app starts.
-	err = db.AutoMigrate(&User{}, &Order{}, &Trade{})
+	err = db.AutoMigrate(&User{}, &Order{}, &Trade{}, &LedgerEntry{})
 	if err != nil {
 		log.Fatalf("failed to migrate database: %v", err)
 	}
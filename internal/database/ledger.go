@@ -0,0 +1,110 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Ledger entry directions. A debit takes value out of an account and a credit
+// puts it in, so for every asset the debits and credits of a trade cancel out.
+const (
+	Debit  = "debit"
+	Credit = "credit"
+)
+
+// FeeAccount is the exchange's own account that collects trading fees.
+const FeeAccount = "fees"
+
+// LedgerEntry maps to the "ledger_entries" table. Each trade writes one
+// balanced set of entries, so summing credits minus debits per asset across
+// every account always gives zero.
+type LedgerEntry struct {
+	ID        uuid.UUID       `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	TradeID   uuid.UUID       `gorm:"type:uuid;index;not null"`
+	Trade     *Trade          `gorm:"foreignKey:TradeID"`
+	Account   string          `gorm:"index;not null"`  // "user:<id>" or FeeAccount
+	UserID    *uuid.UUID      `gorm:"type:uuid;index"` // Nil for the fee account
+	Asset     string          `gorm:"index;not null"`
+	Direction string          `gorm:"not null"` // Debit or Credit
+	Amount    decimal.Decimal `gorm:"type:numeric;not null"`
+	CreatedAt time.Time       `gorm:"not null;default:current_timestamp"`
+}
+
+// TradeSettlement is everything needed to book one trade in the ledger.
+// Each side pays its fee out of the asset it receives: the buyer in base,
+// the seller in quote.
+type TradeSettlement struct {
+	TradeID    uuid.UUID
+	BuyerID    uuid.UUID
+	SellerID   uuid.UUID
+	BaseAsset  string
+	QuoteAsset string
+	Quantity   decimal.Decimal // Base quantity traded
+	Quote      decimal.Decimal // Quote quantity traded
+	BuyerFee   decimal.Decimal // In the base asset
+	SellerFee  decimal.Decimal // In the quote asset
+}
+
+// UserAccount names the ledger account of a user.
+func UserAccount(userID uuid.UUID) string {
+	return "user:" + userID.String()
+}
+
+// TradeEntries returns the balanced ledger entries for a trade: the seller's
+// base goes to the buyer and the buyer's quote to the seller, less each side's
+// fee, which goes to the fee account. It fails if the entries would not balance.
+func TradeEntries(s TradeSettlement) ([]LedgerEntry, error) {
+	if !s.Quantity.IsPositive() || !s.Quote.IsPositive() {
+		return nil, fmt.Errorf("trade %s: quantity and quote must be positive", s.TradeID)
+	}
+	if s.BuyerFee.IsNegative() || s.SellerFee.IsNegative() || s.BuyerFee.GreaterThan(s.Quantity) || s.SellerFee.GreaterThan(s.Quote) {
+		return nil, fmt.Errorf("trade %s: fees must be between zero and the amount received", s.TradeID)
+	}
+
+	user := func(id uuid.UUID, asset, direction string, amount decimal.Decimal) LedgerEntry {
+		return LedgerEntry{TradeID: s.TradeID, Account: UserAccount(id), UserID: &id, Asset: asset, Direction: direction, Amount: amount}
+	}
+	fee := func(asset string, amount decimal.Decimal) LedgerEntry {
+		return LedgerEntry{TradeID: s.TradeID, Account: FeeAccount, Asset: asset, Direction: Credit, Amount: amount}
+	}
+
+	entries := []LedgerEntry{
+		user(s.SellerID, s.BaseAsset, Debit, s.Quantity),
+		user(s.BuyerID, s.BaseAsset, Credit, s.Quantity.Sub(s.BuyerFee)),
+		user(s.BuyerID, s.QuoteAsset, Debit, s.Quote),
+		user(s.SellerID, s.QuoteAsset, Credit, s.Quote.Sub(s.SellerFee)),
+	}
+	if s.BuyerFee.IsPositive() {
+		entries = append(entries, fee(s.BaseAsset, s.BuyerFee))
+	}
+	if s.SellerFee.IsPositive() {
+		entries = append(entries, fee(s.QuoteAsset, s.SellerFee))
+	}
+
+	if asset, ok := balanced(entries); !ok {
+		return nil, fmt.Errorf("trade %s: ledger entries for %s do not balance", s.TradeID, asset)
+	}
+	return entries, nil
+}
+
+// balanced reports whether credits minus debits is zero for every asset,
+// returning the first asset that is off if not.
+func balanced(entries []LedgerEntry) (string, bool) {
+	net := make(map[string]decimal.Decimal)
+	for _, e := range entries {
+		amount := e.Amount
+		if e.Direction == Debit {
+			amount = amount.Neg()
+		}
+		net[e.Asset] = net[e.Asset].Add(amount)
+	}
+	for asset, sum := range net {
+		if !sum.IsZero() {
+			return asset, false
+		}
+	}
+	return "", true
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestTradeEntriesBalancePerAsset(t *testing.T) {
+	buyer, seller := uuid.New(), uuid.New()
+	d := decimal.RequireFromString
+
+	entries, err := TradeEntries(TradeSettlement{
+		TradeID:    uuid.New(),
+		BuyerID:    buyer,
+		SellerID:   seller,
+		BaseAsset:  "SOL",
+		QuoteAsset: "USDC",
+		Quantity:   d("2"),
+		Quote:      d("300"),
+		BuyerFee:   d("0.002"),
+		SellerFee:  d("0.3"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("expected 6 entries, got %d", len(entries))
+	}
+
+	net := make(map[string]decimal.Decimal)
+	for _, e := range entries {
+		amount := e.Amount
+		if e.Direction == Debit {
+			amount = amount.Neg()
+		}
+		net[e.Account+"/"+e.Asset] = net[e.Account+"/"+e.Asset].Add(amount)
+	}
+	want := map[string]string{
+		UserAccount(buyer) + "/SOL":   "1.998",
+		UserAccount(buyer) + "/USDC":  "-300",
+		UserAccount(seller) + "/SOL":  "-2",
+		UserAccount(seller) + "/USDC": "299.7",
+		FeeAccount + "/SOL":           "0.002",
+		FeeAccount + "/USDC":          "0.3",
+	}
+	for key, amount := range want {
+		if !net[key].Equal(d(amount)) {
+			t.Errorf("%s: expected %s, got %s", key, amount, net[key])
+		}
+	}
+}
+
+func TestTradeEntriesSkipZeroFees(t *testing.T) {
+	entries, err := TradeEntries(TradeSettlement{
+		TradeID:    uuid.New(),
+		BuyerID:    uuid.New(),
+		SellerID:   uuid.New(),
+		BaseAsset:  "SOL",
+		QuoteAsset: "USDC",
+		Quantity:   decimal.NewFromInt(1),
+		Quote:      decimal.NewFromInt(150),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Account == FeeAccount {
+			t.Fatalf("expected no fee entries, got %+v", e)
+		}
+	}
+}
+
+func TestTradeEntriesRejectFeesAboveProceeds(t *testing.T) {
+	_, err := TradeEntries(TradeSettlement{
+		TradeID:   uuid.New(),
+		Quantity:  decimal.NewFromInt(1),
+		Quote:     decimal.NewFromInt(150),
+		SellerFee: decimal.NewFromInt(151),
+	})
+	if err == nil {
+		t.Fatal("expected a fee larger than the proceeds to be rejected")
+	}
+}
@@ -22,12 +22,16 @@ type User struct {
 // Order maps to the "orders" table.
 type Order struct {
 	ID          uuid.UUID       `gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	UserID      uuid.UUID       `gorm:"type:uuid;index"`
 	ExecutedQty decimal.Decimal `gorm:"type:numeric"`
 	Market      string
 	Price       string
 	Quantity    string
 	Side        string
-	CreatedAt   time.Time `gorm:"not null;default:current_timestamp"`
+	Status      string
+	Sequence    uint64     // Engine sequence number of the last update applied
+	TriggeredAt *time.Time // Set when a stop order's stop price is reached
+	CreatedAt   time.Time  `gorm:"not null;default:current_timestamp"`
 }
 
 // Trade maps to the "trades" table.
@@ -37,6 +41,24 @@ type Trade struct {
 	Price         string
 	Quantity      string
 	QuoteQuantity string
-	Timestamp     time.Time `gorm:"not null;default:current_timestamp"`
-	Market        string
+	Timestamp     time.Time `gorm:"not null;default:current_timestamp;index"`
+	Market        string    `gorm:"uniqueIndex:idx_trades_market_trade_id"`
+	TradeID       uint64    `gorm:"uniqueIndex:idx_trades_market_trade_id"` // Per-market, counting up from 1
+	Sequence      uint64    // Engine sequence number of the event that produced it
+
+	// The resting (maker) and incoming (taker) sides of the trade.
+	MakerOrderID uuid.UUID `gorm:"type:uuid;index"`
+	MakerOrder   *Order    `gorm:"foreignKey:MakerOrderID"`
+	TakerOrderID uuid.UUID `gorm:"type:uuid;index"`
+	TakerOrder   *Order    `gorm:"foreignKey:TakerOrderID"`
+	MakerUserID  uuid.UUID `gorm:"type:uuid;index"`
+	MakerUser    *User     `gorm:"foreignKey:MakerUserID"`
+	TakerUserID  uuid.UUID `gorm:"type:uuid;index"`
+	TakerUser    *User     `gorm:"foreignKey:TakerUserID"`
+	TakerSide    string
+
+	BuyerID   uuid.UUID       `gorm:"type:uuid;index"`
+	SellerID  uuid.UUID       `gorm:"type:uuid;index"`
+	BuyerFee  decimal.Decimal `gorm:"type:numeric"` // In the base asset
+	SellerFee decimal.Decimal `gorm:"type:numeric"` // In the quote asset
 }
@@ -0,0 +1,28 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// VolumeWindow is how far back trading volume counts towards a user's VIP level.
+const VolumeWindow = 30 * 24 * time.Hour
+
+// TradingVolume sums the quote value of every trade the user took part in,
+// on either side, since the given time. A trade with oneself counts once.
+func TradingVolume(userID uuid.UUID, since time.Time) (decimal.Decimal, error) {
+	var volume decimal.NullDecimal
+	err := DB.Model(&Trade{}).
+		Select("SUM(CAST(quote_quantity AS numeric))").
+		Where("timestamp >= ? AND (buyer_id = ? OR seller_id = ?)", since, userID, userID).
+		Scan(&volume).Error
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if !volume.Valid {
+		return decimal.Zero, nil
+	}
+	return volume.Decimal, nil
+}
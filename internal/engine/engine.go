@@ -0,0 +1,547 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Utsav7428/ChronoXchange/internal/balances"
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/internal/matching"
+	"github.com/Utsav7428/ChronoXchange/internal/wal"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Command types understood by the engine.
+const (
+	CreateOrder = "CREATE_ORDER"
+	CancelOrder = "CANCEL_ORDER"
+	AmendOrder  = "AMEND_ORDER"
+	GetDepth    = "GET_DEPTH"
+	OnRamp      = "ON_RAMP"
+	GetBalances = "GET_BALANCES"
+)
+
+// APIRequestWrapper corresponds to the `MessageWrapper` in the Rust engine.
+type APIRequestWrapper struct {
+	ClientID string          `json:"client_id"` // The channel to send the API response back on
+	UserID   uuid.UUID       `json:"user_id"`
+	Message  json.RawMessage `json:"message"` // The actual command payload
+
+	// DeliveryID is the ID of the queue entry the command arrived in, set by
+	// the engine's consumer, not the API. See Process.
+	DeliveryID string `json:"delivery_id,omitempty"`
+}
+
+// APIMessage corresponds to the `MessageFromApi` enum.
+// Data is decoded once the command type is known.
+type APIMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Engine routes commands to the orderbook of the market they target.
+type Engine struct {
+	registry *markets.Registry
+	books    map[string]*matching.Orderbook
+	expiries expiryQueue
+	funds    *balances.Store
+	locks    map[uuid.UUID]orderLock // Funds locked by each open order
+	levels   map[uuid.UUID]int       // Latest known VIP level of each user, for fees
+	seq      uint64                  // Sequence number of the last engine event
+	streams  map[string]uint64       // Messages published so far on each output stream, by stream
+	delivery string                  // Delivery ID of the last command that could change state
+	kept     map[string]*outputs     // Outputs of replayed commands, by delivery ID, in case they are delivered again
+	keptIDs  []string                // Keys of kept, oldest first
+	now      time.Time               // Clock of the event being applied, from its journal entry
+	journal  *wal.Log                // Nil to run without a write-ahead log
+	replica  Replica                 // Nil to run without a standby
+	clock    func() time.Time        // Time given to each command as it is received
+	newID    func() uuid.UUID        // ID given to each order as it is received
+	pub      Publisher
+}
+
+// Option configures an Engine.
+type Option func(*Engine)
+
+// WithClock makes the engine time commands with now instead of the wall clock.
+func WithClock(now func() time.Time) Option {
+	return func(e *Engine) { e.clock = now }
+}
+
+// WithIDGenerator makes the engine give new orders IDs from newID instead of random UUIDs.
+func WithIDGenerator(newID func() uuid.UUID) Option {
+	return func(e *Engine) { e.newID = newID }
+}
+
+// New creates an engine with one orderbook per market in the registry.
+func New(registry *markets.Registry, pub Publisher, opts ...Option) *Engine {
+	e := &Engine{
+		registry: registry,
+		books:    make(map[string]*matching.Orderbook),
+		funds:    balances.NewStore(),
+		locks:    make(map[uuid.UUID]orderLock),
+		levels:   make(map[uuid.UUID]int),
+		streams:  make(map[string]uint64),
+		clock:    time.Now,
+		newID:    uuid.New,
+		pub:      pub,
+	}
+	for _, m := range registry.All() {
+		e.books[m.Symbol] = matching.NewOrderbook(m.Symbol, e.bookOptions(m)...)
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// bookOptions configures a market's orderbook. Books keep the engine's clock
+// rather than their own, so that a trade is stamped with the time of the
+// command that made it, on replay as much as when it first happened.
+func (e *Engine) bookOptions(m markets.Market) []matching.Option {
+	return []matching.Option{
+		matching.WithTickSize(m.TickSize),
+		matching.WithLotSize(m.LotSize),
+		matching.WithClock(func() time.Time { return e.now }),
+	}
+}
+
+// Process executes a single request from the API and replies on its client channel.
+//
+// A request with a DeliveryID is skipped if its ID is not after that of the
+// last command that could change state, so that a queue which redelivers
+// commands after a crash never gets one applied twice. The last ID is
+// journaled and kept in snapshots along with everything else. IDs must
+// increase in the order commands are delivered, as Redis stream entry IDs
+// ("<millis>-<seq>") do.
+//
+// A skipped command that the engine only replayed from its journal, or from a
+// primary's, has its outputs sent again instead: the engine that first applied
+// it may have stopped before publishing them. Everything downstream copes with
+// duplicates, as the db-processor's writes are idempotent.
+func (e *Engine) Process(req APIRequestWrapper) {
+	if req.DeliveryID != "" && !deliveredAfter(req.DeliveryID, e.delivery) {
+		if out, ok := e.kept[req.DeliveryID]; ok {
+			slog.Warn("resending the outputs of a command that was already handled", "delivery_id", req.DeliveryID)
+			delete(e.kept, req.DeliveryID)
+			out.sendTo(e.pub)
+			return
+		}
+		slog.Warn("skipping command that was already handled", "delivery_id", req.DeliveryID, "last_delivery_id", e.delivery)
+		return
+	}
+	resp := e.execute(req)
+	resp.Sequence = e.seq
+	e.pub.Respond(req.ClientID, resp)
+}
+
+// execute runs a request. A command that can change state is written to the
+// journal first, together with the time and any order ID it is given, and is
+// refused if that fails, so nothing is acknowledged that could not be replayed.
+func (e *Engine) execute(req APIRequestWrapper) types.APIResponse {
+	entry := journalEntry{Kind: entryCommand, Time: e.clock().UnixMilli(), Request: req}
+
+	var msg APIMessage
+	if err := json.Unmarshal(req.Message, &msg); err == nil && mutates(msg.Type) {
+		entry.Seq = e.seq + 1
+		if msg.Type == CreateOrder {
+			entry.OrderID = e.newID()
+		}
+		if err := e.record(entry); err != nil {
+			slog.Error("could not write command to journal", "type", msg.Type, "error", err)
+			return failure("engine could not record the command")
+		}
+	}
+	return e.apply(entry)
+}
+
+// apply runs a command with the engine's clock set to the time it was received.
+func (e *Engine) apply(entry journalEntry) types.APIResponse {
+	e.now = time.UnixMilli(entry.Time)
+	return e.handle(entry)
+}
+
+// Sequence returns the sequence number of the last engine event. Every command
+// that can change state and every expiry is an event, and everything it
+// publishes carries its number to identify it. An event may publish many
+// messages or none, so consumers look for gaps in each message's StreamSeq instead.
+func (e *Engine) Sequence() uint64 {
+	return e.seq
+}
+
+// LastDelivery returns the delivery ID of the last command that could change state.
+func (e *Engine) LastDelivery() string {
+	return e.delivery
+}
+
+// deliveredAfter reports whether delivery ID id comes after last, which is
+// empty before the first. IDs compare as Redis stream entry IDs; one that does
+// not parse as such is always treated as new.
+func deliveredAfter(id, last string) bool {
+	if last == "" {
+		return true
+	}
+	idMillis, idSeq, ok := parseDeliveryID(id)
+	lastMillis, lastSeq, lastOK := parseDeliveryID(last)
+	if !ok || !lastOK {
+		return true
+	}
+	return idMillis > lastMillis || (idMillis == lastMillis && idSeq > lastSeq)
+}
+
+func parseDeliveryID(id string) (uint64, uint64, bool) {
+	millis, seq, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	m, err := strconv.ParseUint(millis, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return m, n, true
+}
+
+// mutates reports whether a command type can change engine state.
+func mutates(msgType string) bool {
+	switch msgType {
+	case CreateOrder, CancelOrder, AmendOrder, OnRamp:
+		return true
+	}
+	return false
+}
+
+func (e *Engine) handle(entry journalEntry) types.APIResponse {
+	req := entry.Request
+
+	// Unmarshal the inner message to determine the command type.
+	var msg APIMessage
+	if err := json.Unmarshal(req.Message, &msg); err != nil {
+		slog.Error("could not unmarshal api message", "error", err)
+		return failure("invalid message")
+	}
+	if mutates(msg.Type) {
+		e.seq++
+		// Only commands that are journaled move the delivery ID on, so that
+		// replaying the journal restores it exactly. Reads are safe to repeat.
+		if req.DeliveryID != "" {
+			e.delivery = req.DeliveryID
+		}
+	}
+
+	switch msg.Type {
+	case CreateOrder:
+		var data types.CreateOrderData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			slog.Error("could not unmarshal create order data", "error", err)
+			return failure("invalid create order payload")
+		}
+		// Orders spend the authenticated user's funds, whatever the payload says.
+		data.UserID = req.UserID
+		data.OrderID = entry.OrderID
+		return e.createOrder(data)
+
+	case CancelOrder:
+		var data types.CancelOrderData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			slog.Error("could not unmarshal cancel order data", "error", err)
+			return failure("invalid cancel order payload")
+		}
+		// The wrapper's user comes from the API's authenticated session, so it wins.
+		data.UserID = req.UserID
+		return e.cancelOrder(data)
+
+	case AmendOrder:
+		var data types.AmendOrderData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			slog.Error("could not unmarshal amend order data", "error", err)
+			return failure("invalid amend order payload")
+		}
+		data.UserID = req.UserID
+		return e.amendOrder(data)
+
+	case GetDepth:
+		var data types.GetDepthData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			slog.Error("could not unmarshal get depth data", "error", err)
+			return failure("invalid get depth payload")
+		}
+		return e.getDepth(data)
+
+	case OnRamp:
+		var data types.OnRampData
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			slog.Error("could not unmarshal on ramp data", "error", err)
+			return failure("invalid on ramp payload")
+		}
+		data.UserID = req.UserID
+		return e.onRamp(data)
+
+	case GetBalances:
+		return e.getBalances(types.GetBalancesData{UserID: req.UserID})
+
+	default:
+		slog.Warn("received unknown message type", "type", msg.Type)
+		return failure("unknown message type")
+	}
+}
+
+func (e *Engine) createOrder(data types.CreateOrderData) types.APIResponse {
+	market, book, err := e.book(data.Market)
+	if err != nil {
+		return failure(err.Error())
+	}
+	// The API checks these rules too, but the engine must never trust its input.
+	if err := market.ValidateOrder(data); err != nil {
+		return rejection(err)
+	}
+	if err := checkOrderShape(data, e.now); err != nil {
+		return failure(err.Error())
+	}
+
+	// Funds are locked before the order reaches the book, so it can never trade more than its owner holds.
+	lock, err := e.lockFor(market, &data)
+	if err != nil {
+		slog.Info("order rejected", "market", market.Symbol, "user_id", data.UserID, "error", err)
+		return insufficientFunds()
+	}
+	// A user's level applies to their resting orders too, so remember it for when they are the maker.
+	e.levels[data.UserID] = data.FeeLevel
+
+	// The AddOrder method returns the order after matching, the trades (fills) it produced,
+	// any resting orders self-trade prevention cancelled and any stop orders it triggered.
+	result, err := book.AddOrder(data)
+	if err != nil {
+		e.funds.Unlock(lock.user, lock.asset, lock.amount)
+		slog.Info("order rejected", "market", market.Symbol, "user_id", data.UserID, "error", err)
+		return rejection(err)
+	}
+	order, fills := result.Order, result.Fills
+	e.locks[order.ID] = lock
+	e.chargeFees(market, result)
+	e.settle(market, book, result)
+
+	// After processing, publish results to other services.
+	e.publishAddResult(market, result)
+	switch order.Status {
+	case types.StatusNew, types.StatusPartiallyFilled, types.StatusUntriggered:
+		e.scheduleExpiry(market.Symbol, order)
+	}
+
+	slog.Info("order processed", "market", market.Symbol, "order_id", order.ID, "fills", len(fills))
+
+	return types.APIResponse{
+		Success: true,
+		Data: types.CreateOrderResponse{
+			OrderID:      order.ID,
+			Fills:        fills,
+			ExecutedQty:  order.Filled,
+			RemainingQty: order.Remaining(),
+			Status:       order.Status,
+		},
+	}
+}
+
+func (e *Engine) cancelOrder(data types.CancelOrderData) types.APIResponse {
+	market, book, err := e.book(data.Market)
+	if err != nil {
+		return failure(err.Error())
+	}
+
+	order, err := book.CancelOrder(data.OrderID, data.UserID)
+	if err != nil {
+		slog.Warn("could not cancel order", "market", market.Symbol, "order_id", data.OrderID, "error", err)
+		return failure(err.Error())
+	}
+
+	e.release(book, order.ID)
+	e.publishOrderUpdate(market.Symbol, *order)
+
+	slog.Info("order cancelled", "market", market.Symbol, "order_id", order.ID)
+
+	return types.APIResponse{
+		Success: true,
+		Data:    types.CancelOrderResponse{OrderID: order.ID, Success: true},
+	}
+}
+
+func (e *Engine) amendOrder(data types.AmendOrderData) types.APIResponse {
+	market, book, err := e.book(data.Market)
+	if err != nil {
+		return failure(err.Error())
+	}
+	if err := market.ValidateAmend(data); err != nil {
+		return rejection(err)
+	}
+	if data.Price.IsZero() && data.Quantity.IsZero() {
+		return failure("amend must change price or quantity")
+	}
+
+	// Amending happens inside the book in one step, so the order is never
+	// briefly missing the way it would be between a cancel and a new order.
+	if !e.lockAmendment(book, data) {
+		return insufficientFunds()
+	}
+	result, err := book.AmendOrder(data)
+	if err != nil {
+		e.release(book, data.OrderID)
+		slog.Warn("could not amend order", "market", market.Symbol, "order_id", data.OrderID, "error", err)
+		return rejection(err)
+	}
+	order, fills := result.Order, result.Fills
+	e.chargeFees(market, result)
+	e.settle(market, book, result)
+
+	e.publishAddResult(market, result)
+
+	slog.Info("order amended", "market", market.Symbol, "order_id", order.ID, "fills", len(fills))
+
+	return types.APIResponse{
+		Success: true,
+		Data: types.AmendOrderResponse{
+			OrderID:      order.ID,
+			Fills:        fills,
+			ExecutedQty:  order.Filled,
+			RemainingQty: order.Remaining(),
+			Status:       order.Status,
+		},
+	}
+}
+
+func (e *Engine) onRamp(data types.OnRampData) types.APIResponse {
+	if data.Asset == "" || !data.Amount.IsPositive() {
+		return failure("on ramp needs an asset and a positive amount")
+	}
+	e.funds.Credit(data.UserID, data.Asset, data.Amount)
+
+	slog.Info("funds credited", "user_id", data.UserID, "asset", data.Asset, "amount", data.Amount)
+
+	return e.getBalances(types.GetBalancesData{UserID: data.UserID})
+}
+
+func (e *Engine) getBalances(data types.GetBalancesData) types.APIResponse {
+	return types.APIResponse{
+		Success: true,
+		Data:    types.BalancesResponse{Balances: e.funds.Balances(data.UserID)},
+	}
+}
+
+func (e *Engine) getDepth(data types.GetDepthData) types.APIResponse {
+	_, book, err := e.book(data.Market)
+	if err != nil {
+		return failure(err.Error())
+	}
+	return types.APIResponse{
+		Success: true,
+		Data:    types.GetDepthResponse{Depth: book.Depth(data.Limit)},
+	}
+}
+
+// book resolves a market symbol to its definition and orderbook.
+func (e *Engine) book(symbol string) (markets.Market, *matching.Orderbook, error) {
+	market, err := e.registry.Get(symbol)
+	if err != nil {
+		return markets.Market{}, nil, err
+	}
+	return market, e.books[symbol], nil
+}
+
+// checkOrderShape rejects combinations of fields that make no sense for the order type.
+func checkOrderShape(data types.CreateOrderData, now time.Time) error {
+	if data.Side != types.Buy && data.Side != types.Sell {
+		return errors.New("side must be buy or sell")
+	}
+	switch data.Type {
+	case types.Market, types.StopMarket:
+		if data.Quantity.IsPositive() == data.QuoteQuantity.IsPositive() {
+			return errors.New("market orders need exactly one of quantity or quote_quantity")
+		}
+		if data.MaxSlippage.IsNegative() || data.MaxSlippage.GreaterThanOrEqual(decimal.NewFromInt(1)) {
+			return errors.New("max_slippage must be between 0 and 1")
+		}
+	case types.Limit, types.StopLimit, "":
+		if !data.Price.IsPositive() || !data.Quantity.IsPositive() {
+			return errors.New("limit orders need a positive price and quantity")
+		}
+		if !data.QuoteQuantity.IsZero() {
+			return errors.New("quote_quantity is only supported on market orders")
+		}
+	default:
+		return errors.New("unknown order type " + string(data.Type))
+	}
+
+	if data.DisplayQuantity.IsPositive() {
+		if data.Type != types.Limit && data.Type != types.StopLimit && data.Type != "" {
+			return errors.New("display_quantity is only supported on limit orders")
+		}
+		if data.DisplayQuantity.GreaterThanOrEqual(data.Quantity) {
+			return errors.New("display_quantity must be less than quantity")
+		}
+		if data.TimeInForce == types.IOC || data.TimeInForce == types.FOK {
+			return errors.New("iceberg orders must be able to rest on the book")
+		}
+	} else if data.DisplayQuantity.IsNegative() {
+		return errors.New("display_quantity must be positive")
+	}
+
+	isStop := data.Type == types.StopMarket || data.Type == types.StopLimit
+	if isStop != data.StopPrice.IsPositive() {
+		return errors.New("stop_price is required on stop orders and only allowed on them")
+	}
+
+	if data.PostOnly && (data.Type != types.Limit && data.Type != "" || data.TimeInForce == types.IOC || data.TimeInForce == types.FOK) {
+		return errors.New("post-only orders must be limit orders that can rest on the book")
+	}
+
+	switch data.SelfTradePrevention {
+	case "", types.CancelNewest, types.CancelOldest, types.CancelBoth, types.DecrementAndCancel:
+	default:
+		return errors.New("unknown self trade prevention mode " + string(data.SelfTradePrevention))
+	}
+
+	switch data.TimeInForce {
+	case types.GTC, types.IOC, "":
+	case types.FOK:
+		if data.QuoteQuantity.IsPositive() {
+			return errors.New("FOK orders must specify a base quantity")
+		}
+	case types.GTD:
+		if data.Type == types.Market || data.Type == types.StopMarket {
+			return errors.New("market orders cannot be GTD")
+		}
+		if data.ExpireAt <= now.UnixMilli() {
+			return errors.New("GTD orders need an expire_at in the future")
+		}
+	default:
+		return errors.New("unknown time in force " + string(data.TimeInForce))
+	}
+	return nil
+}
+
+func failure(message string) types.APIResponse {
+	return types.APIResponse{Success: false, Message: message}
+}
+
+// rejection turns an error into a failed response, keeping its code if it broke
+// a market rule or a post-only order would have crossed.
+func rejection(err error) types.APIResponse {
+	resp := failure(err.Error())
+	var invalid *markets.ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		resp.Code = invalid.Code
+	case errors.Is(err, matching.ErrPostOnlyWouldCross):
+		resp.Code = matching.CodePostOnlyWouldCross
+	}
+	return resp
+}
@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"container/heap"
+	"log/slog"
+	"time"
+
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+)
+
+// expiryEntry schedules a good-till-date order to leave the book.
+type expiryEntry struct {
+	at      int64 // Unix milliseconds
+	market  string
+	orderID uuid.UUID
+}
+
+// expiryQueue is a min-heap of scheduled expiries, soonest first.
+// Entries for orders that were filled or cancelled in the meantime are
+// skipped when they come due rather than removed eagerly.
+type expiryQueue []expiryEntry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at < q[j].at }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(expiryEntry)) }
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// scheduleExpiry registers a resting GTD order with the scheduler.
+func (e *Engine) scheduleExpiry(market string, order types.Order) {
+	if order.TimeInForce != types.GTD || order.ExpireAt == 0 {
+		return
+	}
+	heap.Push(&e.expiries, expiryEntry{at: order.ExpireAt, market: market, orderID: order.ID})
+}
+
+// ExpireDue removes every GTD order whose expiry is at or before now and
+// reports each one to the db-processor as expired. The main loop calls it
+// between commands so expiries are applied in order with everything else.
+func (e *Engine) ExpireDue(now time.Time) {
+	e.expireDue(now, true)
+}
+
+// expireDue does the work of ExpireDue. When record is set, the sweep is written
+// to the journal before the first order it removes; sweeps that find only
+// orders which already left the book are not worth recording.
+func (e *Engine) expireDue(now time.Time, record bool) {
+	nowMillis := now.UnixMilli()
+	e.now = time.UnixMilli(nowMillis)
+	for e.expiries.Len() > 0 && e.expiries[0].at <= nowMillis {
+		entry := heap.Pop(&e.expiries).(expiryEntry)
+
+		book := e.books[entry.market]
+		if _, open := book.Order(entry.orderID); !open {
+			// Already filled or cancelled.
+			continue
+		}
+		if record {
+			if err := e.record(journalEntry{Seq: e.seq + 1, Kind: entryExpire, Time: nowMillis}); err != nil {
+				slog.Error("could not write expiry to journal", "error", err)
+				heap.Push(&e.expiries, entry)
+				return
+			}
+			record = false
+		}
+
+		order, err := book.ExpireOrder(entry.orderID)
+		if err != nil {
+			continue
+		}
+
+		e.seq++
+		e.release(book, order.ID)
+		e.publishOrderUpdate(entry.market, *order)
+		slog.Info("order expired", "market", entry.market, "order_id", order.ID)
+	}
+}
@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/internal/matching"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/shopspring/decimal"
+)
+
+// chargeFees sets the maker and taker fee on every fill in an add result,
+// including the fills of any stop orders it triggered. Each side pays its
+// rate for its VIP level on the amount it receives.
+func (e *Engine) chargeFees(market markets.Market, result matching.AddResult) {
+	taker := result.Order
+	takerRates := market.Rates(e.levels[taker.UserID])
+	for i := range result.Fills {
+		fill := &result.Fills[i]
+		makerRates := market.Rates(e.levels[fill.MakerUserID])
+
+		base, quote := fill.Qty, fill.Qty.Mul(fill.Price)
+		if taker.Side == types.Buy {
+			fill.TakerFee = base.Mul(takerRates.Taker)
+			fill.MakerFee = quote.Mul(makerRates.Maker)
+		} else {
+			fill.TakerFee = quote.Mul(takerRates.Taker)
+			fill.MakerFee = base.Mul(makerRates.Maker)
+		}
+	}
+	for _, triggered := range result.Triggered {
+		e.chargeFees(market, triggered)
+	}
+}
+
+// buyerSellerFees splits a fill's fees between its buyer and seller.
+func buyerSellerFees(fill types.Fill) (buyerFee, sellerFee decimal.Decimal) {
+	if fill.TakerSide == types.Buy {
+		return fill.TakerFee, fill.MakerFee
+	}
+	return fill.MakerFee, fill.TakerFee
+}
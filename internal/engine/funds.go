@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"github.com/Utsav7428/ChronoXchange/internal/balances"
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/internal/matching"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// orderLock is the part of a user's locked balance that backs one open order.
+type orderLock struct {
+	user   uuid.UUID
+	asset  string
+	amount decimal.Decimal
+}
+
+// spendAsset returns the asset an order pays with: quote for buys, base for sells.
+func spendAsset(market markets.Market, side types.OrderSide) string {
+	if side == types.Buy {
+		return market.QuoteAsset
+	}
+	return market.BaseAsset
+}
+
+// required returns how much an open order needs locked to pay for the rest of it.
+func required(order types.Order) decimal.Decimal {
+	if order.Side == types.Buy {
+		return order.Price.Mul(order.Remaining())
+	}
+	return order.Remaining()
+}
+
+// lockFor locks the funds a new order needs and records how much its owner may spend.
+// Limit orders lock exactly what they can cost. A market order sized in the asset it
+// receives has no known cost up front, so it locks the user's whole available balance
+// and is capped at that through Funds; whatever it does not spend is released afterwards.
+// A stop-market order may wait a long time to trigger, so rather than hold the whole
+// balance it locks what it would cost at its stop price moved by its maximum slippage,
+// and is capped at that instead.
+func (e *Engine) lockFor(market markets.Market, data *types.CreateOrderData) (orderLock, error) {
+	lock := orderLock{user: data.UserID, asset: spendAsset(market, data.Side)}
+	data.Funds = decimal.Zero
+
+	one := decimal.NewFromInt(1)
+	switch {
+	case data.Type != types.Market && data.Type != types.StopMarket:
+		lock.amount = required(types.Order{Side: data.Side, Price: data.Price, Quantity: data.Quantity})
+	case data.Side == types.Buy && data.QuoteQuantity.IsPositive():
+		lock.amount = data.QuoteQuantity
+	case data.Side == types.Sell && data.Quantity.IsPositive():
+		lock.amount = data.Quantity
+	case data.Type == types.StopMarket && data.Side == types.Buy:
+		lock.amount = data.Quantity.Mul(data.StopPrice).Mul(one.Add(data.MaxSlippage))
+		data.Funds = lock.amount
+	case data.Type == types.StopMarket:
+		lock.amount = data.QuoteQuantity.Div(data.StopPrice.Mul(one.Sub(data.MaxSlippage)))
+		data.Funds = lock.amount
+	default:
+		lock.amount = e.funds.Available(data.UserID, lock.asset)
+		data.Funds = lock.amount
+	}
+
+	if !lock.amount.IsPositive() {
+		return lock, balances.ErrInsufficientFunds
+	}
+	if err := e.funds.Lock(lock.user, lock.asset, lock.amount); err != nil {
+		return lock, err
+	}
+	return lock, nil
+}
+
+// insufficientFunds is the response for an order its owner cannot pay for.
+func insufficientFunds() types.APIResponse {
+	resp := failure(balances.ErrInsufficientFunds.Error())
+	resp.Code = balances.CodeInsufficientFunds
+	return resp
+}
+
+// lockAmendment locks any extra funds an amend needs before it reaches the book,
+// reporting false if the owner cannot afford it. Amends the book will reject are
+// let through so that the book reports why.
+func (e *Engine) lockAmendment(book *matching.Orderbook, data types.AmendOrderData) bool {
+	order, ok := book.Order(data.OrderID)
+	lock, locked := e.locks[data.OrderID]
+	if !ok || !locked || order.UserID != data.UserID {
+		return true
+	}
+
+	if data.Price.IsPositive() {
+		order.Price = data.Price
+	}
+	if data.Quantity.IsPositive() {
+		order.Quantity = data.Quantity
+	}
+	extra := required(order).Sub(lock.amount)
+	if !extra.IsPositive() {
+		return true
+	}
+	if err := e.funds.Lock(lock.user, lock.asset, extra); err != nil {
+		return false
+	}
+	lock.amount = lock.amount.Add(extra)
+	e.locks[data.OrderID] = lock
+	return true
+}
+
+// settle moves funds for every fill in an add result, including the fills of any
+// stop orders it triggered, then releases whatever locked funds are no longer needed.
+// Fees are kept back from what each side receives and credited to the fee account.
+//
+// Locks are only released once every fill is paid for: the book already shows
+// each order as it is after the last of them, and one maker can be in several,
+// when an iceberg refills or a triggered stop trades with it again.
+func (e *Engine) settle(market markets.Market, book *matching.Orderbook, result matching.AddResult) {
+	var touched []uuid.UUID
+	seen := make(map[uuid.UUID]bool)
+	e.settleFills(market, result, func(orderID uuid.UUID) {
+		if !seen[orderID] {
+			seen[orderID] = true
+			touched = append(touched, orderID)
+		}
+	})
+	for _, orderID := range touched {
+		e.release(book, orderID)
+	}
+}
+
+// settleFills pays for the fills in an add result and those of the stops it
+// triggered, passing touch every order whose locked funds may no longer be needed.
+func (e *Engine) settleFills(market markets.Market, result matching.AddResult, touch func(orderID uuid.UUID)) {
+	taker := result.Order
+	for _, fill := range result.Fills {
+		base, quote := fill.Qty, fill.Qty.Mul(fill.Price)
+		buyerFee, sellerFee := buyerSellerFees(fill)
+		if taker.Side == types.Buy {
+			e.spend(taker.ID, taker.UserID, market.QuoteAsset, quote)
+			e.funds.Credit(taker.UserID, market.BaseAsset, base.Sub(buyerFee))
+			e.spend(fill.MakerOrderID, fill.MakerUserID, market.BaseAsset, base)
+			e.funds.Credit(fill.MakerUserID, market.QuoteAsset, quote.Sub(sellerFee))
+		} else {
+			e.spend(taker.ID, taker.UserID, market.BaseAsset, base)
+			e.funds.Credit(taker.UserID, market.QuoteAsset, quote.Sub(sellerFee))
+			e.spend(fill.MakerOrderID, fill.MakerUserID, market.QuoteAsset, quote)
+			e.funds.Credit(fill.MakerUserID, market.BaseAsset, base.Sub(buyerFee))
+		}
+		if buyerFee.IsPositive() {
+			e.funds.Credit(balances.FeeAccount, market.BaseAsset, buyerFee)
+		}
+		if sellerFee.IsPositive() {
+			e.funds.Credit(balances.FeeAccount, market.QuoteAsset, sellerFee)
+		}
+		touch(fill.MakerOrderID)
+	}
+	touch(taker.ID)
+	for _, cancelled := range result.Cancelled {
+		touch(cancelled.ID)
+	}
+	for _, decremented := range result.Decremented {
+		touch(decremented.ID)
+	}
+	for _, triggered := range result.Triggered {
+		e.settleFills(market, triggered, touch)
+	}
+}
+
+// spend pays amount out of an order's locked funds.
+func (e *Engine) spend(orderID, user uuid.UUID, asset string, amount decimal.Decimal) {
+	e.funds.Spend(user, asset, amount)
+	if lock, ok := e.locks[orderID]; ok {
+		lock.amount = lock.amount.Sub(amount)
+		e.locks[orderID] = lock
+	}
+}
+
+// release unlocks whatever an order has locked beyond what it still needs.
+// Orders that are no longer on the book need nothing; untriggered stops keep
+// their whole lock until they trade.
+func (e *Engine) release(book *matching.Orderbook, orderID uuid.UUID) {
+	lock, ok := e.locks[orderID]
+	if !ok {
+		return
+	}
+
+	keep := decimal.Zero
+	if order, open := book.Order(orderID); open {
+		if order.Status == types.StatusUntriggered {
+			return
+		}
+		keep = required(order)
+	}
+
+	if excess := lock.amount.Sub(keep); excess.IsPositive() {
+		e.funds.Unlock(lock.user, lock.asset, excess)
+		lock.amount = keep
+	}
+	if lock.amount.IsPositive() {
+		e.locks[orderID] = lock
+	} else {
+		delete(e.locks, orderID)
+	}
+}
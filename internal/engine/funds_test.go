@@ -0,0 +1,281 @@
+package engine
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Utsav7428/ChronoXchange/internal/balances"
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/internal/matching"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// command runs one request through the engine as the given user.
+func command(t *testing.T, e *Engine, user uuid.UUID, msgType string, data interface{}) types.APIResponse {
+	t.Helper()
+	payload, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := json.Marshal(APIMessage{Type: msgType, Data: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e.execute(APIRequestWrapper{UserID: user, Message: msg})
+}
+
+func assertBalance(t *testing.T, e *Engine, user uuid.UUID, asset, available, locked string) {
+	t.Helper()
+	got := e.funds.Balances(user)[asset]
+	if !got.Available.Equal(decimal.RequireFromString(available)) || !got.Locked.Equal(decimal.RequireFromString(locked)) {
+		t.Fatalf("%s: expected %s available / %s locked, got %s / %s", asset, available, locked, got.Available, got.Locked)
+	}
+}
+
+// assertLocksMatch checks that what each user has locked is exactly what
+// their open orders hold, and never negative.
+func assertLocksMatch(t *testing.T, e *Engine, users ...uuid.UUID) {
+	t.Helper()
+	for _, user := range users {
+		held := make(map[string]decimal.Decimal)
+		for _, lock := range e.locks {
+			if lock.user == user {
+				held[lock.asset] = held[lock.asset].Add(lock.amount)
+			}
+		}
+		for asset, balance := range e.funds.Balances(user) {
+			if balance.Locked.IsNegative() || !balance.Locked.Equal(held[asset]) {
+				t.Fatalf("%s: %s locked, but open orders hold %s", asset, balance.Locked, held[asset])
+			}
+		}
+	}
+}
+
+func TestFundsLockSettleAndRelease(t *testing.T) {
+	e := New(markets.Default(), discard{})
+	buyer, seller := uuid.New(), uuid.New()
+	command(t, e, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, e, seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+
+	order := func(user uuid.UUID, side types.OrderSide, price, qty string) types.APIResponse {
+		return command(t, e, user, CreateOrder, types.CreateOrderData{
+			Market:   "SOL_USDC",
+			Side:     side,
+			Price:    decimal.RequireFromString(price),
+			Quantity: decimal.RequireFromString(qty),
+		})
+	}
+
+	if resp := order(buyer, types.Buy, "100", "11"); resp.Success || resp.Code != balances.CodeInsufficientFunds {
+		t.Fatalf("expected an insufficient funds rejection, got %+v", resp)
+	}
+	assertBalance(t, e, buyer, "USDC", "1000", "0")
+
+	resp := order(seller, types.Sell, "90", "4")
+	if !resp.Success {
+		t.Fatalf("sell rejected: %s", resp.Message)
+	}
+	assertBalance(t, e, seller, "SOL", "6", "4")
+
+	// The buy locks 5 at 100, trades 4 at 90 and keeps 1 at 100 locked for the rest.
+	if resp := order(buyer, types.Buy, "100", "5"); !resp.Success {
+		t.Fatalf("buy rejected: %s", resp.Message)
+	}
+	assertBalance(t, e, buyer, "USDC", "540", "100")
+	assertBalance(t, e, buyer, "SOL", "4", "0")
+	assertBalance(t, e, seller, "SOL", "6", "0")
+	assertBalance(t, e, seller, "USDC", "360", "0")
+
+	resting := command(t, e, buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(50), Quantity: decimal.NewFromInt(2)})
+	orderID := resting.Data.(types.CreateOrderResponse).OrderID
+	assertBalance(t, e, buyer, "USDC", "440", "200")
+
+	command(t, e, buyer, CancelOrder, types.CancelOrderData{OrderID: orderID, Market: "SOL_USDC"})
+	assertBalance(t, e, buyer, "USDC", "540", "100")
+
+	// A market buy sized in base has no known cost, so it borrows the whole balance and returns the rest.
+	order(seller, types.Sell, "100.5", "2")
+	resp = command(t, e, buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Type: types.Market, Side: types.Buy, Quantity: decimal.NewFromInt(1)})
+	if !resp.Success || resp.Data.(types.CreateOrderResponse).Status != types.StatusFilled {
+		t.Fatalf("expected the market buy to fill, got %+v", resp)
+	}
+	assertBalance(t, e, buyer, "USDC", "439.5", "100")
+	assertBalance(t, e, buyer, "SOL", "5", "0")
+}
+
+func TestStopMarketLocksOnlyItsBoundedCost(t *testing.T) {
+	e := New(markets.Default(), discard{})
+	buyer, seller, other := uuid.New(), uuid.New(), uuid.New()
+	command(t, e, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, e, seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	command(t, e, other, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+
+	// 1 SOL at a stop of 100 with 5% slippage can cost at most 105.
+	stop := command(t, e, buyer, CreateOrder, types.CreateOrderData{
+		Market: "SOL_USDC", Type: types.StopMarket, Side: types.Buy,
+		StopPrice: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(1), MaxSlippage: decimal.RequireFromString("0.05"),
+	})
+	if !stop.Success {
+		t.Fatalf("stop-market rejected: %s", stop.Message)
+	}
+	assertBalance(t, e, buyer, "USDC", "895", "105")
+
+	// The rest of the balance stays free for other orders while the stop waits.
+	if resp := command(t, e, buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(90), Quantity: decimal.RequireFromString("0.1")}); !resp.Success {
+		t.Fatalf("limit buy rejected: %+v", resp)
+	}
+	assertBalance(t, e, buyer, "USDC", "886", "114")
+
+	// A trade at 100 triggers the stop, which buys at 100 and returns the 5 it did not need.
+	command(t, e, seller, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(2)})
+	command(t, e, other, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(1)})
+	assertBalance(t, e, buyer, "USDC", "891", "9")
+	assertBalance(t, e, buyer, "SOL", "1", "0")
+}
+
+func TestFeesKeptBackFromWhatEachSideReceives(t *testing.T) {
+	registry, err := markets.NewRegistry([]markets.Market{{
+		Symbol:     "SOL_USDC",
+		BaseAsset:  "SOL",
+		QuoteAsset: "USDC",
+		TickSize:   decimal.RequireFromString("0.01"),
+		LotSize:    decimal.RequireFromString("0.01"),
+		Fees: []markets.FeeRates{
+			{Maker: decimal.RequireFromString("0.001"), Taker: decimal.RequireFromString("0.002")},
+			{Maker: decimal.Zero, Taker: decimal.RequireFromString("0.001")},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(registry, discard{})
+	maker, taker := uuid.New(), uuid.New()
+	command(t, e, maker, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	command(t, e, taker, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+
+	command(t, e, maker, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(5)})
+	resp := command(t, e, taker, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(5), FeeLevel: 1})
+	fills := resp.Data.(types.CreateOrderResponse).Fills
+	if len(fills) != 1 || !fills[0].TakerFee.Equal(decimal.RequireFromString("0.005")) || !fills[0].MakerFee.Equal(decimal.RequireFromString("0.5")) {
+		t.Fatalf("unexpected fees: %+v", fills)
+	}
+
+	// The taker buys at level 1 and pays 0.1% of the SOL received; the maker pays 0.1% of the USDC.
+	assertBalance(t, e, taker, "SOL", "4.995", "0")
+	assertBalance(t, e, taker, "USDC", "500", "0")
+	assertBalance(t, e, maker, "USDC", "499.5", "0")
+	assertBalance(t, e, balances.FeeAccount, "SOL", "0.005", "0")
+	assertBalance(t, e, balances.FeeAccount, "USDC", "0.5", "0")
+}
+
+func TestMakerInSeveralFillsKeepsItsLock(t *testing.T) {
+	e := New(markets.Default(), discard{})
+	buyer, seller, other := uuid.New(), uuid.New(), uuid.New()
+	command(t, e, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, e, seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	command(t, e, other, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+
+	// An iceberg refills twice inside one buy, so it makes three fills.
+	command(t, e, seller, CreateOrder, types.CreateOrderData{
+		Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(100),
+		Quantity: decimal.NewFromInt(3), DisplayQuantity: decimal.NewFromInt(1),
+	})
+	resp := command(t, e, buyer, CreateOrder, types.CreateOrderData{
+		Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(100),
+		Quantity: decimal.RequireFromString("2.5"), TimeInForce: types.FOK,
+	})
+	if fills := resp.Data.(types.CreateOrderResponse).Fills; len(fills) != 3 {
+		t.Fatalf("expected three fills against the iceberg, got %d", len(fills))
+	}
+	assertBalance(t, e, seller, "SOL", "7", "0.5")
+	assertLocksMatch(t, e, buyer, seller)
+
+	// A trade at 99 triggers a sell stop, which sells into the same bid again.
+	command(t, e, buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(99), Quantity: decimal.NewFromInt(5)})
+	command(t, e, other, CreateOrder, types.CreateOrderData{
+		Market: "SOL_USDC", Type: types.StopMarket, Side: types.Sell,
+		StopPrice: decimal.NewFromInt(99), Quantity: decimal.NewFromInt(2),
+	})
+	command(t, e, seller, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Type: types.Market, Side: types.Sell, Quantity: decimal.NewFromInt(1)})
+	assertBalance(t, e, buyer, "USDC", "255", "198")
+	assertLocksMatch(t, e, buyer, seller, other)
+}
+
+func TestMarketFillOrKillBuyIsKilledWhenFundsFallShort(t *testing.T) {
+	e := New(markets.Default(), discard{})
+	buyer, seller := uuid.New(), uuid.New()
+	command(t, e, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(250)})
+	command(t, e, seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	command(t, e, seller, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(5)})
+
+	// The book holds all 5 SOL, but 250 USDC pays for only 2.5 of them.
+	resp := command(t, e, buyer, CreateOrder, types.CreateOrderData{
+		Market: "SOL_USDC", Type: types.Market, Side: types.Buy,
+		Quantity: decimal.NewFromInt(5), TimeInForce: types.FOK,
+	})
+	if data := resp.Data.(types.CreateOrderResponse); len(data.Fills) != 0 || data.Status != types.StatusCancelled {
+		t.Fatalf("expected the FOK order to be killed untouched, got %d fills, status %s", len(data.Fills), data.Status)
+	}
+	assertBalance(t, e, buyer, "USDC", "250", "0")
+	assertBalance(t, e, seller, "SOL", "5", "5")
+}
+
+func TestDecrementedRestingOrderReleasesItsExcess(t *testing.T) {
+	pub := &recorder{}
+	e := New(markets.Default(), pub)
+	user := uuid.New()
+	command(t, e, user, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, e, user, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	resting := command(t, e, user, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(3)})
+	restingID := resting.Data.(types.CreateOrderResponse).OrderID
+
+	pub.db = nil
+	command(t, e, user, CreateOrder, types.CreateOrderData{
+		Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(100),
+		Quantity: decimal.NewFromInt(1), SelfTradePrevention: types.DecrementAndCancel,
+	})
+	assertBalance(t, e, user, "SOL", "8", "2")
+	assertBalance(t, e, user, "USDC", "1000", "0")
+	assertLocksMatch(t, e, user)
+
+	var update *types.DBOrderMessage
+	for _, msg := range pub.db {
+		if m, ok := msg.(types.DBOrderMessage); ok && m.OrderID == restingID {
+			update = &m
+		}
+	}
+	if update == nil || update.Quantity != "2" || update.Status != types.StatusNew {
+		t.Fatalf("expected an update shrinking the resting order to 2, got %+v", update)
+	}
+}
+
+func TestPostOnlyRejectionHasACodeAndFreesItsFunds(t *testing.T) {
+	e := New(markets.Default(), discard{})
+	buyer, seller := uuid.New(), uuid.New()
+	command(t, e, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, e, seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	command(t, e, seller, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(1)})
+
+	postOnly := func(price int64) types.APIResponse {
+		return command(t, e, buyer, CreateOrder, types.CreateOrderData{
+			Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(price),
+			Quantity: decimal.NewFromInt(1), PostOnly: true,
+		})
+	}
+	if resp := postOnly(100); resp.Success || resp.Code != matching.CodePostOnlyWouldCross {
+		t.Fatalf("expected a %s rejection, got %+v", matching.CodePostOnlyWouldCross, resp)
+	}
+	assertBalance(t, e, buyer, "USDC", "1000", "0")
+
+	// Amending a resting post-only order across the spread is rejected the same way.
+	resting := postOnly(99)
+	orderID := resting.Data.(types.CreateOrderResponse).OrderID
+	resp := command(t, e, buyer, AmendOrder, types.AmendOrderData{OrderID: orderID, Market: "SOL_USDC", Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(1)})
+	if resp.Success || resp.Code != matching.CodePostOnlyWouldCross {
+		t.Fatalf("expected a %s rejection, got %+v", matching.CodePostOnlyWouldCross, resp)
+	}
+	assertBalance(t, e, buyer, "USDC", "901", "99")
+}
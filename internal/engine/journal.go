@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Utsav7428/ChronoXchange/internal/wal"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+)
+
+// Journal entry kinds.
+const (
+	entryCommand = "command" // A request from the API
+	entryExpire  = "expire"  // An expiry sweep that removed at least one order
+)
+
+// journalEntry is one engine event as written to the write-ahead log. It holds
+// everything that is not in the request itself but decides its outcome, so
+// that replaying it rebuilds exactly the same state.
+type journalEntry struct {
+	Seq     uint64            `json:"seq"`
+	Kind    string            `json:"kind"`
+	Time    int64             `json:"time"`               // Unix milliseconds, the engine's clock for the event
+	OrderID uuid.UUID         `json:"order_id,omitempty"` // ID given to an order created by the command
+	Request APIRequestWrapper `json:"request"`
+}
+
+// WithJournal makes the engine write every command that can change state to
+// log before applying it.
+func WithJournal(log *wal.Log) Option {
+	return func(e *Engine) { e.journal = log }
+}
+
+// record writes an entry to the journal, if there is one, and ships it to the standby.
+func (e *Engine) record(entry journalEntry) error {
+	if e.journal == nil {
+		return nil
+	}
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := e.journal.Append(entry.Seq, payload); err != nil {
+		return err
+	}
+	e.ship(entry.Seq, payload)
+	return nil
+}
+
+// Recover rebuilds the engine's state by replaying its journal. Nothing is
+// published while replaying: the outputs of each command are kept instead, in
+// case the engine stopped before sending them and the command is delivered
+// again. See Process. It must be called before the engine processes anything new.
+//
+// A journal compacted against a snapshot the engine did not load starts past
+// the engine's sequence number, and is refused rather than replayed onto the
+// wrong state.
+func (e *Engine) Recover() error {
+	if e.journal == nil {
+		return nil
+	}
+
+	replayed := 0
+	err := e.journal.Replay(e.seq, func(seq uint64, payload []byte) error {
+		if replayed == 0 && seq != e.seq+1 {
+			return fmt.Errorf("journal resumes at entry %d but the engine is at %d; load the snapshot it was compacted against", seq, e.seq)
+		}
+		if err := e.replayKeepingOutputs(payload); err != nil {
+			return fmt.Errorf("journal entry %d: %w", seq, err)
+		}
+		replayed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("engine state recovered", "entries", replayed, "sequence", e.seq)
+	return nil
+}
+
+// Replay applies one record from a journal written by another engine, or by
+// this one before a restart, without writing it to the journal again. What it
+// produces goes to the engine's publisher as it did the first time, so
+// replaying a journal into a fresh engine reproduces its fills exactly.
+func (e *Engine) Replay(payload []byte) error {
+	var entry journalEntry
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return err
+	}
+	e.replay(entry)
+	return nil
+}
+
+// replayKeepingOutputs applies one journal record like Replay, but keeps what
+// a command publishes, response included, under its delivery ID rather than
+// sending it.
+func (e *Engine) replayKeepingOutputs(payload []byte) error {
+	var entry journalEntry
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return err
+	}
+
+	pub, out := e.pub, &outputs{}
+	e.pub = out
+	resp := e.replay(entry)
+	e.pub = pub
+
+	if id := entry.Request.DeliveryID; entry.Kind == entryCommand && id != "" {
+		resp.Sequence = e.seq
+		out.Respond(entry.Request.ClientID, resp)
+		e.keepOutputs(id, out)
+	}
+	return nil
+}
+
+// replay applies one journal entry without writing it to the journal again,
+// and returns the response to a command.
+func (e *Engine) replay(entry journalEntry) types.APIResponse {
+	var resp types.APIResponse
+	switch entry.Kind {
+	case entryExpire:
+		e.expireDue(time.UnixMilli(entry.Time), false)
+	default:
+		resp = e.apply(entry)
+	}
+	if e.seq < entry.Seq {
+		slog.Warn("journal entry did not advance the sequence", "entry", entry.Seq, "sequence", e.seq)
+	}
+	return resp
+}
+
+// maxKeptOutputs bounds how many replayed commands keep their outputs. Only a
+// command that was never acked is delivered again, which is at most the few
+// in flight when the engine that applied it stopped.
+const maxKeptOutputs = 1024
+
+// keepOutputs keeps what the command delivered as id published, dropping the
+// oldest kept once there are more than maxKeptOutputs.
+func (e *Engine) keepOutputs(id string, out *outputs) {
+	if e.kept == nil {
+		e.kept = make(map[string]*outputs)
+	}
+	e.kept[id] = out
+	e.keptIDs = append(e.keptIDs, id)
+	if len(e.keptIDs) > maxKeptOutputs {
+		delete(e.kept, e.keptIDs[0])
+		e.keptIDs = e.keptIDs[1:]
+	}
+}
+
+// outputs is a Publisher that keeps what it is given, to be sent later.
+type outputs []func(Publisher)
+
+func (o *outputs) Respond(clientID string, resp types.APIResponse) {
+	*o = append(*o, func(p Publisher) { p.Respond(clientID, resp) })
+}
+
+func (o *outputs) PushDB(msg interface{}) {
+	*o = append(*o, func(p Publisher) { p.PushDB(msg) })
+}
+
+func (o *outputs) PublishWS(msg types.WsMessage) {
+	*o = append(*o, func(p Publisher) { p.PublishWS(msg) })
+}
+
+// sendTo publishes everything kept, in the order it was given.
+func (o *outputs) sendTo(p Publisher) {
+	for _, send := range *o {
+		send(p)
+	}
+}
+
+// discard is a Publisher that drops everything.
+type discard struct{}
+
+func (discard) Respond(string, types.APIResponse) {}
+func (discard) PushDB(interface{})                {}
+func (discard) PublishWS(types.WsMessage)         {}
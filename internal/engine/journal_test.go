@@ -0,0 +1,210 @@
+package engine
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/internal/wal"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestRecoverReplaysTheJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "engine.wal")
+	log, err := wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(markets.Default(), discard{}, WithJournal(log))
+	buyer, seller := uuid.New(), uuid.New()
+
+	command(t, e, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, e, seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	command(t, e, seller, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(101), Quantity: decimal.NewFromInt(3)})
+	command(t, e, buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(101), Quantity: decimal.NewFromInt(1)})
+	resting := command(t, e, buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(99), Quantity: decimal.NewFromInt(2)})
+	expiring := command(t, e, buyer, CreateOrder, types.CreateOrderData{
+		Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(98), Quantity: decimal.NewFromInt(1),
+		TimeInForce: types.GTD, ExpireAt: time.Now().Add(time.Minute).UnixMilli(),
+	})
+	command(t, e, buyer, GetDepth, types.GetDepthData{Market: "SOL_USDC"})
+	e.ExpireDue(time.Now().Add(2 * time.Minute))
+	log.Close()
+
+	log, err = wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	recovered := New(markets.Default(), discard{}, WithJournal(log))
+	if err := recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	if recovered.Sequence() != e.Sequence() {
+		t.Fatalf("expected sequence %d after recovery, got %d", e.Sequence(), recovered.Sequence())
+	}
+	want, got := e.books["SOL_USDC"].Depth(0), recovered.books["SOL_USDC"].Depth(0)
+	if len(got.Bids) != 1 || len(got.Asks) != 1 || !got.Bids[0][0].Equal(want.Bids[0][0]) || !got.Asks[0][1].Equal(want.Asks[0][1]) {
+		t.Fatalf("expected depth %+v after recovery, got %+v", want, got)
+	}
+	for _, user := range []uuid.UUID{buyer, seller} {
+		for asset, balance := range e.funds.Balances(user) {
+			assertBalance(t, recovered, user, asset, balance.Available.String(), balance.Locked.String())
+		}
+	}
+	if _, ok := recovered.books["SOL_USDC"].Order(expiring.Data.(types.CreateOrderResponse).OrderID); ok {
+		t.Fatal("expected the GTD order to have expired during replay")
+	}
+
+	// Orders keep their IDs, so commands that refer to them still work after a restart.
+	orderID := resting.Data.(types.CreateOrderResponse).OrderID
+	if resp := command(t, recovered, buyer, CancelOrder, types.CancelOrderData{OrderID: orderID, Market: "SOL_USDC"}); !resp.Success {
+		t.Fatalf("could not cancel a recovered order: %s", resp.Message)
+	}
+}
+
+func TestRedeliveredCommandsAreSkipped(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "engine.wal")
+	log, err := wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(markets.Default(), discard{}, WithJournal(log))
+	user := uuid.New()
+
+	deliver := func(e *Engine, id string, amount int64) {
+		t.Helper()
+		payload, _ := json.Marshal(types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(amount)})
+		msg, _ := json.Marshal(APIMessage{Type: OnRamp, Data: payload})
+		e.Process(APIRequestWrapper{UserID: user, Message: msg, DeliveryID: id})
+	}
+	deliver(e, "1700000000000-0", 100)
+	deliver(e, "1700000000000-0", 100)
+	deliver(e, "1700000000000-1", 10)
+	if _, err := e.SaveSnapshot(dir); err != nil {
+		t.Fatal(err)
+	}
+	deliver(e, "1700000000001-0", 1)
+	deliver(e, "1700000000000-1", 10)
+	assertBalance(t, e, user, "USDC", "111", "0")
+	log.Close()
+
+	// After a restart the engine still knows which commands it has applied,
+	// whether it learns that from a snapshot or from the journal after it.
+	log, err = wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	recovered := New(markets.Default(), discard{}, WithJournal(log))
+	if _, err := recovered.LoadSnapshot(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := recovered.LastDelivery(); got != "1700000000000-1" {
+		t.Fatalf("expected the snapshot to hold the last delivery ID, got %q", got)
+	}
+	if err := recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	deliver(recovered, "1700000000001-0", 1)
+	deliver(recovered, "1700000000002-0", 1000)
+	assertBalance(t, recovered, user, "USDC", "1111", "0")
+}
+
+// crash is a Publisher that stops the engine at its first output, as a crash
+// between writing a command to the journal and publishing it would.
+type crash struct{}
+
+func (crash) Respond(string, types.APIResponse) { panic("crash") }
+func (crash) PushDB(interface{})                { panic("crash") }
+func (crash) PublishWS(types.WsMessage)         { panic("crash") }
+
+func TestRedeliveryResendsOutputsLostInACrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "engine.wal")
+	log, err := wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(markets.Default(), discard{}, WithJournal(log))
+	buyer, seller := uuid.New(), uuid.New()
+	command(t, e, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, e, seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	command(t, e, seller, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(2)})
+
+	payload, _ := json.Marshal(types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(2)})
+	msg, _ := json.Marshal(APIMessage{Type: CreateOrder, Data: payload})
+	req := APIRequestWrapper{ClientID: "client", UserID: buyer, Message: msg, DeliveryID: "1700000000000-0"}
+	e.pub = crash{}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the engine to stop before publishing")
+			}
+		}()
+		e.Process(req)
+	}()
+	log.Close()
+
+	log, err = wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	pub := &recorder{}
+	recovered := New(markets.Default(), pub, WithJournal(log))
+	if err := recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.responses)+len(pub.db)+len(pub.ws) != 0 {
+		t.Fatal("expected nothing to be published while recovering")
+	}
+
+	// The command was applied before the crash, so it is not applied again,
+	// but everything it should have published is.
+	recovered.Process(req)
+	assertBalance(t, recovered, buyer, "USDC", "800", "0")
+	if len(pub.responses) != 1 || !pub.responses[0].Success || pub.responses[0].Sequence != recovered.Sequence() {
+		t.Fatalf("expected the original response to be resent, got %+v", pub.responses)
+	}
+	trades := 0
+	for _, m := range pub.db {
+		if _, ok := m.(types.DBTradeMessage); ok {
+			trades++
+		}
+	}
+	if trades != 1 || len(pub.ws) != 1 {
+		t.Fatalf("expected the fill to be resent to the db-processor and WebSocket server, got %+v and %+v", pub.db, pub.ws)
+	}
+
+	// Once resent, it is skipped like any other redelivery.
+	recovered.Process(req)
+	if len(pub.responses) != 1 {
+		t.Fatalf("expected outputs to be resent only once, got %d responses", len(pub.responses))
+	}
+}
+
+func TestDeliveredAfter(t *testing.T) {
+	cases := []struct {
+		id, last string
+		want     bool
+	}{
+		{"5-0", "", true},
+		{"5-1", "5-0", true},
+		{"10-0", "9-99", true},
+		{"5-0", "5-0", false},
+		{"9-99", "10-0", false},
+		{"not-an-id", "5-0", true},
+	}
+	for _, c := range cases {
+		if got := deliveredAfter(c.id, c.last); got != c.want {
+			t.Errorf("deliveredAfter(%q, %q) = %v, want %v", c.id, c.last, got, c.want)
+		}
+	}
+}
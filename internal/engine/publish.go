@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/internal/matching"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+)
+
+// Publisher delivers engine output to the API, the db-processor and the WebSocket server.
+type Publisher interface {
+	// Respond replies to the API request waiting on clientID.
+	Respond(clientID string, resp types.APIResponse)
+	// PushDB queues a message for the db-processor.
+	PushDB(msg interface{})
+	// PublishWS broadcasts a message to WebSocket subscribers.
+	PublishWS(msg types.WsMessage)
+}
+
+// dbStream names the db-processor queue among the engine's output streams.
+// WebSocket streams are named after what they carry, such as "trades@SOL_USDC".
+const dbStream = "db"
+
+// next counts one more message published on stream and returns its position there.
+func (e *Engine) next(stream string) uint64 {
+	e.streams[stream]++
+	return e.streams[stream]
+}
+
+// tradeNamespace scopes the UUIDs derived from per-market trade IDs.
+var tradeNamespace = uuid.MustParse("fe10a7af-3c55-4534-8e65-38b291c33bd2")
+
+// tradeUUID derives a trade's database ID from its market and trade ID,
+// so publishing the same trade twice can never create two rows.
+func tradeUUID(market string, tradeID uint64) uuid.UUID {
+	return uuid.NewSHA1(tradeNamespace, []byte(fmt.Sprintf("%s:%d", market, tradeID)))
+}
+
+// publishAddResult publishes the order updates and fills produced by adding an
+// order, followed by each stop order it triggered, in the order they executed.
+// The incoming order is published before its fills so that the trades it
+// took part in can refer to it, and the resting orders they filled after them.
+func (e *Engine) publishAddResult(market markets.Market, result matching.AddResult) {
+	e.publishOrderUpdate(market.Symbol, result.Order)
+	e.publishFills(market, result.Fills)
+	for _, maker := range result.Makers {
+		e.publishOrderUpdate(market.Symbol, maker)
+	}
+	for _, cancelled := range result.Cancelled {
+		e.publishOrderUpdate(market.Symbol, cancelled)
+	}
+	for _, decremented := range result.Decremented {
+		e.publishOrderUpdate(market.Symbol, decremented)
+	}
+	for _, triggered := range result.Triggered {
+		e.publishTrigger(market.Symbol, triggered.Order)
+		e.publishAddResult(market, triggered)
+	}
+}
+
+// publishTrigger announces that a stop order's stop price was reached.
+func (e *Engine) publishTrigger(market string, order types.Order) {
+	now := e.now.UnixMilli()
+
+	e.pub.PushDB(types.DBOrderMessage{
+		Type:        "ORDER_TRIGGERED",
+		Sequence:    e.seq,
+		StreamSeq:   e.next(dbStream),
+		OrderID:     order.ID,
+		UserID:      order.UserID,
+		ExecutedQty: order.Filled,
+		Market:      market,
+		Price:       order.Price.String(),
+		Quantity:    order.Quantity.String(),
+		Side:        order.Side,
+		Status:      order.Status,
+		TriggeredAt: now,
+	})
+
+	stream := "triggers@" + market
+	e.pub.PublishWS(types.WsMessage{
+		Stream:    stream,
+		Sequence:  e.seq,
+		StreamSeq: e.next(stream),
+		Data: types.TriggerData{
+			EventType: "triggered",
+			OrderID:   order.ID,
+			Side:      order.Side,
+			OrderType: order.Type,
+			StopPrice: order.StopPrice,
+			Market:    market,
+			Timestamp: now,
+		},
+	})
+
+	slog.Info("stop order triggered", "market", market, "order_id", order.ID, "stop_price", order.StopPrice)
+}
+
+// publishFills sends each fill to the db-processor and the WebSocket server.
+func (e *Engine) publishFills(market markets.Market, fills []types.Fill) {
+	for _, fill := range fills {
+		buyerFee, sellerFee := buyerSellerFees(fill)
+
+		// --- Task 1: Publish to DB Processor ---
+		e.pub.PushDB(types.DBTradeMessage{
+			Type:          "TRADE_ADDED",
+			Sequence:      e.seq,
+			StreamSeq:     e.next(dbStream),
+			ID:            tradeUUID(market.Symbol, fill.TradeID),
+			TradeID:       fill.TradeID,
+			IsBuyerMaker:  fill.IsBuyerMaker(),
+			Price:         fill.Price.String(),
+			Quantity:      fill.Qty.String(),
+			QuoteQuantity: fill.Price.Mul(fill.Qty).String(),
+			Timestamp:     fill.Timestamp,
+			Market:        market.Symbol,
+
+			MakerOrderID: fill.MakerOrderID,
+			TakerOrderID: fill.TakerOrderID,
+			MakerUserID:  fill.MakerUserID,
+			TakerUserID:  fill.TakerUserID,
+			TakerSide:    fill.TakerSide,
+
+			BuyerID:    fill.Buyer(),
+			SellerID:   fill.Seller(),
+			BaseAsset:  market.BaseAsset,
+			QuoteAsset: market.QuoteAsset,
+			BuyerFee:   buyerFee,
+			SellerFee:  sellerFee,
+		})
+
+		// --- Task 2: Publish to WebSocket Hub ---
+		stream := "trades@" + market.Symbol
+		e.pub.PublishWS(types.WsMessage{
+			Stream:    stream,
+			Sequence:  e.seq,
+			StreamSeq: e.next(stream),
+			Data: types.TradeData{
+				EventType:    "trade",
+				TradeID:      fill.TradeID,
+				Price:        fill.Price,
+				Quantity:     fill.Qty,
+				IsBuyerMaker: fill.IsBuyerMaker(),
+				Market:       market.Symbol,
+				Timestamp:    fill.Timestamp,
+			},
+		})
+	}
+}
+
+// publishOrderUpdate sends the current state of an order to the db-processor.
+func (e *Engine) publishOrderUpdate(market string, order types.Order) {
+	e.pub.PushDB(types.DBOrderMessage{
+		Type:        "ORDER_UPDATE",
+		Sequence:    e.seq,
+		StreamSeq:   e.next(dbStream),
+		OrderID:     order.ID,
+		UserID:      order.UserID,
+		ExecutedQty: order.Filled,
+		Market:      market,
+		Price:       order.Price.String(),
+		Quantity:    order.Quantity.String(),
+		Side:        order.Side,
+		Status:      order.Status,
+	})
+}
@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// recorder is a Publisher that keeps everything it is given.
+type recorder struct {
+	responses []types.APIResponse
+	db        []interface{}
+	ws        []types.WsMessage
+}
+
+func (r *recorder) Respond(_ string, resp types.APIResponse) { r.responses = append(r.responses, resp) }
+func (r *recorder) PushDB(msg interface{})                   { r.db = append(r.db, msg) }
+func (r *recorder) PublishWS(msg types.WsMessage)            { r.ws = append(r.ws, msg) }
+
+func TestOutputsCarryTheEventSequence(t *testing.T) {
+	pub := &recorder{}
+	e := New(markets.Default(), pub)
+	buyer, seller := uuid.New(), uuid.New()
+
+	run := func(user uuid.UUID, msgType string, data interface{}) {
+		t.Helper()
+		payload, _ := json.Marshal(data)
+		msg, _ := json.Marshal(APIMessage{Type: msgType, Data: payload})
+		e.Process(APIRequestWrapper{UserID: user, Message: msg})
+	}
+	run(buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	run(seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	run(seller, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(2)})
+	run(uuid.Nil, GetDepth, types.GetDepthData{Market: "SOL_USDC"})
+	run(buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(2)})
+
+	// Reads report the current sequence without starting a new event.
+	for i, want := range []uint64{1, 2, 3, 3, 4} {
+		if got := pub.responses[i].Sequence; got != want {
+			t.Fatalf("response %d: expected sequence %d, got %d", i, want, got)
+		}
+	}
+
+	var trade types.DBTradeMessage
+	for _, msg := range pub.db {
+		if m, ok := msg.(types.DBTradeMessage); ok {
+			trade = m
+		}
+	}
+	if trade.Sequence != 4 || trade.TradeID != 1 || trade.ID != tradeUUID("SOL_USDC", 1) {
+		t.Fatalf("unexpected trade message: %+v", trade)
+	}
+	if len(pub.ws) != 1 || pub.ws[0].Sequence != 4 {
+		t.Fatalf("expected one trade on the WebSocket stream at sequence 4, got %+v", pub.ws)
+	}
+}
+
+func TestMakersGetAnOrderUpdateAfterTheirFills(t *testing.T) {
+	pub := &recorder{}
+	e := New(markets.Default(), pub)
+	buyer, seller, stopper := uuid.New(), uuid.New(), uuid.New()
+	command(t, e, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, e, stopper, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, e, seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+
+	sell := func(price, qty int64) uuid.UUID {
+		resp := command(t, e, seller, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(price), Quantity: decimal.NewFromInt(qty)})
+		return resp.Data.(types.CreateOrderResponse).OrderID
+	}
+	first, second := sell(100, 1), sell(101, 2)
+	command(t, e, stopper, CreateOrder, types.CreateOrderData{
+		Market: "SOL_USDC", Type: types.StopMarket, Side: types.Buy,
+		StopPrice: decimal.NewFromInt(101), Quantity: decimal.NewFromInt(1), MaxSlippage: decimal.RequireFromString("0.05"),
+	})
+
+	// The buy fills both asks and trades at 101, so the stop buys from the second ask again.
+	pub.db = nil
+	command(t, e, buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(101), Quantity: decimal.RequireFromString("1.5")})
+
+	var got []string
+	for _, msg := range pub.db {
+		switch m := msg.(type) {
+		case types.DBTradeMessage:
+			got = append(got, "trade "+m.Quantity)
+		case types.DBOrderMessage:
+			switch m.OrderID {
+			case first:
+				got = append(got, "first "+m.ExecutedQty.String())
+			case second:
+				got = append(got, "second "+m.ExecutedQty.String())
+			}
+		}
+	}
+	want := []string{"trade 1", "trade 0.5", "first 1", "second 0.5", "trade 1", "second 1.5"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected maker updates %v, got %v", want, got)
+	}
+}
+
+func TestStreamSequencesCountEachMessageWithoutGaps(t *testing.T) {
+	pub := &recorder{}
+	e := New(markets.Default(), pub)
+	buyer, seller := uuid.New(), uuid.New()
+	command(t, e, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, e, seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	sell := func(e *Engine, price int64) {
+		command(t, e, seller, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(price), Quantity: decimal.NewFromInt(1)})
+	}
+	sell(e, 100)
+	sell(e, 101)
+
+	// A snapshot carries the counters over, so a restarted engine picks up where this one stopped.
+	var snap bytes.Buffer
+	if err := e.WriteSnapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	restored := New(markets.Default(), pub)
+	if err := restored.ReadSnapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	// One event, two trades: each stream counts both messages.
+	command(t, restored, buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(101), Quantity: decimal.NewFromInt(2)})
+
+	var db []uint64
+	for _, msg := range pub.db {
+		switch m := msg.(type) {
+		case types.DBTradeMessage:
+			db = append(db, m.StreamSeq)
+		case types.DBOrderMessage:
+			db = append(db, m.StreamSeq)
+		}
+	}
+	for i, seq := range db {
+		if seq != uint64(i+1) {
+			t.Fatalf("expected the db-processor queue to count 1 to %d, got %v", len(db), db)
+		}
+	}
+	if len(pub.ws) != 2 || pub.ws[0].StreamSeq != 1 || pub.ws[1].StreamSeq != 2 || pub.ws[0].Sequence != pub.ws[1].Sequence {
+		t.Fatalf("expected two trades from one event at stream positions 1 and 2, got %+v", pub.ws)
+	}
+}
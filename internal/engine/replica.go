@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var (
+	// ErrReplicationGap is returned when a standby is given a journal record
+	// that does not follow the last one it applied.
+	ErrReplicationGap = errors.New("replication: journal record out of sequence")
+	// ErrStateDiverged is returned when a standby's state hash differs from the primary's.
+	ErrStateDiverged = errors.New("replication: state differs from the primary")
+)
+
+// Replica receives every journal record once the engine has written it to
+// its own journal, so that a standby engine can apply the same commands.
+type Replica interface {
+	Ship(seq uint64, payload []byte) error
+}
+
+// WithReplica makes the engine ship every journal record to r.
+func WithReplica(r Replica) Option {
+	return func(e *Engine) { e.replica = r }
+}
+
+// ship sends a journal record to the replica, if there is one. The record is
+// already in the local journal and the command is applied regardless, so a
+// failure is only logged; the standby sees the gap and stops following.
+func (e *Engine) ship(seq uint64, payload []byte) {
+	if e.replica == nil {
+		return
+	}
+	if err := e.replica.Ship(seq, payload); err != nil {
+		slog.Error("could not ship journal record to standby", "sequence", seq, "error", err)
+	}
+}
+
+// Follow applies a journal record shipped by the primary, writing it to this
+// engine's own journal first so that a standby can restart, or take over,
+// from where it is. Records it already has are ignored. Nothing is published,
+// as the primary sends every output, but outputs are kept as Recover keeps
+// them, for commands the primary stopped before publishing.
+func (e *Engine) Follow(seq uint64, payload []byte) error {
+	if seq <= e.seq {
+		return nil
+	}
+	if seq != e.seq+1 {
+		return fmt.Errorf("%w: got %d after %d", ErrReplicationGap, seq, e.seq)
+	}
+	if e.journal != nil {
+		if err := e.journal.Append(seq, payload); err != nil {
+			return err
+		}
+	}
+
+	if err := e.replayKeepingOutputs(payload); err != nil {
+		return err
+	}
+	if e.seq < seq {
+		return fmt.Errorf("%w: record %d did not apply", ErrStateDiverged, seq)
+	}
+	return nil
+}
+
+// Verify compares the engine's state with a state hash the primary took at
+// sequence number seq. It must be called when the engine is at that sequence
+// number, which a standby is once it has followed every record up to it.
+func (e *Engine) Verify(seq uint64, hash []byte) error {
+	if e.seq != seq {
+		return fmt.Errorf("%w: hash is for sequence %d, standby is at %d", ErrReplicationGap, seq, e.seq)
+	}
+	state, err := e.StateHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(state, hash) {
+		return fmt.Errorf("%w at sequence %d", ErrStateDiverged, seq)
+	}
+	return nil
+}
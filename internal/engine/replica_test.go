@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/internal/wal"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// shipped is a Replica that keeps the records it is given.
+type shipped struct {
+	seqs     []uint64
+	payloads [][]byte
+}
+
+func (s *shipped) Ship(seq uint64, payload []byte) error {
+	s.seqs = append(s.seqs, seq)
+	s.payloads = append(s.payloads, payload)
+	return nil
+}
+
+func openJournal(t *testing.T, path string) *wal.Log {
+	t.Helper()
+	log, err := wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { log.Close() })
+	return log
+}
+
+func TestStandbyFollowsThePrimary(t *testing.T) {
+	dir := t.TempDir()
+	replica := &shipped{}
+	primary := New(markets.Default(), discard{}, WithJournal(openJournal(t, filepath.Join(dir, "primary.wal"))), WithReplica(replica))
+	buyer, seller := uuid.New(), uuid.New()
+
+	command(t, primary, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, primary, seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	command(t, primary, seller, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(2)})
+	command(t, primary, buyer, GetDepth, types.GetDepthData{Market: "SOL_USDC"})
+	command(t, primary, buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(1)})
+	if len(replica.seqs) != 4 {
+		t.Fatalf("expected the 4 commands that change state to be shipped, got %v", replica.seqs)
+	}
+
+	standbyPath := filepath.Join(dir, "standby.wal")
+	standby := New(markets.Default(), discard{}, WithJournal(openJournal(t, standbyPath)))
+
+	// A record that skips ahead cannot be applied.
+	if err := standby.Follow(replica.seqs[1], replica.payloads[1]); !errors.Is(err, ErrReplicationGap) {
+		t.Fatalf("expected a gap to be refused, got %v", err)
+	}
+	for i, seq := range replica.seqs {
+		if err := standby.Follow(seq, replica.payloads[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Records delivered again are ignored.
+	if err := standby.Follow(replica.seqs[0], replica.payloads[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := primary.StateHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := standby.Verify(primary.Sequence(), hash); err != nil {
+		t.Fatalf("expected the standby to match the primary: %v", err)
+	}
+	assertBalance(t, standby, buyer, "USDC", "900", "0")
+
+	// Once the standby has diverged, the next hash shows it.
+	command(t, standby, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1)})
+	command(t, primary, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(2)})
+	if hash, err = primary.StateHash(); err != nil {
+		t.Fatal(err)
+	}
+	if err := standby.Verify(primary.Sequence(), hash); !errors.Is(err, ErrStateDiverged) {
+		t.Fatalf("expected divergence to be detected, got %v", err)
+	}
+}
+
+func TestPromotedStandbyContinuesItsOwnJournal(t *testing.T) {
+	dir := t.TempDir()
+	replica := &shipped{}
+	primary := New(markets.Default(), discard{}, WithJournal(openJournal(t, filepath.Join(dir, "primary.wal"))), WithReplica(replica))
+	user := uuid.New()
+	command(t, primary, user, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(100)})
+
+	standbyPath := filepath.Join(dir, "standby.wal")
+	standby := New(markets.Default(), discard{}, WithJournal(openJournal(t, standbyPath)))
+	if err := standby.Follow(replica.seqs[0], replica.payloads[0]); err != nil {
+		t.Fatal(err)
+	}
+	// Promoted, the standby takes commands of its own after the ones it followed.
+	command(t, standby, user, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(50)})
+
+	restarted := New(markets.Default(), discard{}, WithJournal(openJournal(t, standbyPath)))
+	if err := restarted.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Sequence() != 2 {
+		t.Fatalf("expected sequence 2 after recovering the promoted standby, got %d", restarted.Sequence())
+	}
+	assertBalance(t, restarted, user, "USDC", "150", "0")
+}
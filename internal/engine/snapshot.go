@@ -0,0 +1,297 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Utsav7428/ChronoXchange/internal/balances"
+	"github.com/Utsav7428/ChronoXchange/internal/matching"
+	"github.com/Utsav7428/ChronoXchange/internal/snapshot"
+
+	"github.com/google/uuid"
+)
+
+const (
+	snapshotMagic   = "CXEN"
+	snapshotVersion = 1
+
+	// snapshotsKept is how many snapshot files SaveSnapshot leaves on disk, so
+	// there is an older one to fall back on if the newest turns out damaged.
+	snapshotsKept = 2
+)
+
+// snapshotPattern matches the files written by SaveSnapshot. The sequence
+// number is zero-padded so that names sort in the order they were taken.
+const snapshotPattern = "snapshot-*.snap"
+
+// WriteSnapshot writes the engine's state as of its current sequence number:
+// every order book, every balance, the funds locked by each open order, each
+// user's fee level, the last delivery ID and how many messages each output
+// stream has carried. Replaying the journal entries after that sequence
+// number on top of the snapshot gives the same state as replaying all of it.
+func (e *Engine) WriteSnapshot(w io.Writer) error {
+	sw := snapshot.NewWriter(w, snapshotMagic, snapshotVersion)
+	sw.Uint64(e.seq)
+	sw.String(e.delivery)
+
+	symbols := make([]string, 0, len(e.books))
+	for symbol := range e.books {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	sw.Uint32(uint32(len(symbols)))
+	for _, symbol := range symbols {
+		var buf bytes.Buffer
+		if err := e.books[symbol].WriteSnapshot(&buf); err != nil {
+			return fmt.Errorf("order book %s: %w", symbol, err)
+		}
+		sw.String(symbol)
+		sw.Bytes(buf.Bytes())
+	}
+
+	e.funds.WriteSnapshot(sw)
+
+	orderIDs := make([]uuid.UUID, 0, len(e.locks))
+	for id := range e.locks {
+		orderIDs = append(orderIDs, id)
+	}
+	sort.Slice(orderIDs, func(i, j int) bool { return orderIDs[i].String() < orderIDs[j].String() })
+	sw.Uint32(uint32(len(orderIDs)))
+	for _, id := range orderIDs {
+		lock := e.locks[id]
+		sw.UUID(id)
+		sw.UUID(lock.user)
+		sw.String(lock.asset)
+		sw.Decimal(lock.amount)
+	}
+
+	users := make([]uuid.UUID, 0, len(e.levels))
+	for user := range e.levels {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].String() < users[j].String() })
+	sw.Uint32(uint32(len(users)))
+	for _, user := range users {
+		sw.UUID(user)
+		sw.Int64(int64(e.levels[user]))
+	}
+
+	streams := make([]string, 0, len(e.streams))
+	for stream := range e.streams {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	sw.Uint32(uint32(len(streams)))
+	for _, stream := range streams {
+		sw.String(stream)
+		sw.Uint64(e.streams[stream])
+	}
+
+	return sw.Close()
+}
+
+// ReadSnapshot replaces the engine's state with a snapshot written by
+// WriteSnapshot, leaving it untouched if the snapshot cannot be read. It must
+// be called before the engine processes anything.
+//
+// Markets added to the registry since the snapshot start with empty books;
+// a snapshot holding a market the registry no longer has is refused, since
+// its orders could never be traded or cancelled.
+func (e *Engine) ReadSnapshot(r io.Reader) error {
+	sr := snapshot.NewReader(r, snapshotMagic)
+	if sr.Err() == nil && sr.Version != snapshotVersion {
+		return fmt.Errorf("engine snapshot version %d is not supported", sr.Version)
+	}
+	seq := sr.Uint64()
+	delivery := sr.String()
+
+	books := make(map[string]*matching.Orderbook, len(e.books))
+	for symbol, book := range e.books {
+		books[symbol] = book
+	}
+	count := sr.Uint32()
+	for i := uint32(0); i < count && sr.Err() == nil; i++ {
+		symbol := sr.String()
+		data := sr.Bytes()
+		if sr.Err() != nil {
+			break
+		}
+		market, err := e.registry.Get(symbol)
+		if err != nil {
+			return fmt.Errorf("snapshot has order book %s: %w", symbol, err)
+		}
+		book, err := matching.ReadSnapshot(bytes.NewReader(data), e.bookOptions(market)...)
+		if err != nil {
+			return fmt.Errorf("order book %s: %w", symbol, err)
+		}
+		books[symbol] = book
+	}
+
+	funds := balances.NewStore()
+	funds.ReadSnapshot(sr)
+
+	locks := make(map[uuid.UUID]orderLock)
+	count = sr.Uint32()
+	for i := uint32(0); i < count && sr.Err() == nil; i++ {
+		id := sr.UUID()
+		locks[id] = orderLock{user: sr.UUID(), asset: sr.String(), amount: sr.Decimal()}
+	}
+
+	levels := make(map[uuid.UUID]int)
+	count = sr.Uint32()
+	for i := uint32(0); i < count && sr.Err() == nil; i++ {
+		user := sr.UUID()
+		levels[user] = int(sr.Int64())
+	}
+
+	streams := make(map[string]uint64)
+	count = sr.Uint32()
+	for i := uint32(0); i < count && sr.Err() == nil; i++ {
+		stream := sr.String()
+		streams[stream] = sr.Uint64()
+	}
+
+	if err := sr.Close(); err != nil {
+		return err
+	}
+
+	e.seq = seq
+	e.delivery = delivery
+	e.books = books
+	e.funds = funds
+	e.locks = locks
+	e.levels = levels
+	e.streams = streams
+	e.expiries = nil
+	for symbol, book := range e.books {
+		for _, order := range book.Orders() {
+			e.scheduleExpiry(symbol, order)
+		}
+	}
+	return nil
+}
+
+// SaveSnapshot writes a snapshot into dir, named after the engine's sequence
+// number, and removes all but the newest few. The file is written under a
+// temporary name and renamed once synced, so a crash never leaves a partial
+// snapshot where LoadSnapshot would find it.
+//
+// Journal records up to the oldest snapshot kept are then dropped, as nothing
+// replays them any more: LoadSnapshot only falls back as far as that one.
+func (e *Engine) SaveSnapshot(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, "snapshot-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	if err := e.WriteSnapshot(f); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("snapshot-%020d.snap", e.seq))
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+	if err := syncDir(dir); err != nil {
+		return "", err
+	}
+
+	paths, err := snapshotFiles(dir)
+	if err != nil {
+		return path, err
+	}
+	for len(paths) > snapshotsKept {
+		if err := os.Remove(paths[0]); err != nil {
+			slog.Warn("could not remove old snapshot", "path", paths[0], "error", err)
+		}
+		paths = paths[1:]
+	}
+	e.compactJournal(paths[0])
+	return path, nil
+}
+
+// compactJournal drops the journal records that the snapshot at oldest, the
+// oldest one kept, already covers. A log that cannot be compacted is only
+// longer to replay, so failures are logged.
+func (e *Engine) compactJournal(oldest string) {
+	if e.journal == nil {
+		return
+	}
+	var seq uint64
+	if _, err := fmt.Sscanf(filepath.Base(oldest), "snapshot-%d.snap", &seq); err != nil {
+		slog.Warn("could not tell the sequence number of a snapshot", "path", oldest, "error", err)
+		return
+	}
+	if err := e.journal.Compact(seq); err != nil {
+		slog.Warn("could not compact the journal", "up_to", seq, "error", err)
+	}
+}
+
+// syncDir makes the snapshot renamed into dir survive a power loss, which it
+// must before the journal records it covers are dropped.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// LoadSnapshot restores the newest usable snapshot in dir, falling back to
+// older ones if it cannot be read. It returns the path it loaded, or an empty
+// path if dir holds no snapshots, in which case the engine is left as it was.
+func (e *Engine) LoadSnapshot(dir string) (string, error) {
+	paths, err := snapshotFiles(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var errs []error
+	for i := len(paths) - 1; i >= 0; i-- {
+		err := e.loadSnapshotFile(paths[i])
+		if err == nil {
+			return paths[i], nil
+		}
+		slog.Error("could not load snapshot", "path", paths[i], "error", err)
+		errs = append(errs, fmt.Errorf("%s: %w", paths[i], err))
+	}
+	return "", errors.Join(errs...)
+}
+
+func (e *Engine) loadSnapshotFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return e.ReadSnapshot(f)
+}
+
+// snapshotFiles lists the snapshots in dir, oldest first.
+func snapshotFiles(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, snapshotPattern))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Utsav7428/ChronoXchange/internal/markets"
+	"github.com/Utsav7428/ChronoXchange/internal/wal"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestRecoverFromSnapshotReplaysOnlyLaterEntries(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "engine.wal")
+	log, err := wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(markets.Default(), discard{}, WithJournal(log))
+	buyer, seller := uuid.New(), uuid.New()
+
+	command(t, e, buyer, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(1000)})
+	command(t, e, seller, OnRamp, types.OnRampData{Asset: "SOL", Amount: decimal.NewFromInt(10)})
+	command(t, e, seller, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Sell, Price: decimal.NewFromInt(101), Quantity: decimal.NewFromInt(3)})
+	expiring := command(t, e, buyer, CreateOrder, types.CreateOrderData{
+		Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(98), Quantity: decimal.NewFromInt(1),
+		TimeInForce: types.GTD, ExpireAt: time.Now().Add(time.Minute).UnixMilli(),
+	})
+	if _, err := e.SaveSnapshot(dir); err != nil {
+		t.Fatal(err)
+	}
+	snapshotSeq := e.Sequence()
+
+	command(t, e, buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(101), Quantity: decimal.NewFromInt(1)})
+	resting := command(t, e, buyer, CreateOrder, types.CreateOrderData{Market: "SOL_USDC", Side: types.Buy, Price: decimal.NewFromInt(99), Quantity: decimal.NewFromInt(2)})
+	log.Close()
+
+	log, err = wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	recovered := New(markets.Default(), discard{}, WithJournal(log))
+	if loaded, err := recovered.LoadSnapshot(dir); err != nil || loaded == "" {
+		t.Fatalf("expected to load a snapshot, got %q (%v)", loaded, err)
+	}
+	if recovered.Sequence() != snapshotSeq {
+		t.Fatalf("expected sequence %d from the snapshot, got %d", snapshotSeq, recovered.Sequence())
+	}
+	if err := recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	if recovered.Sequence() != e.Sequence() {
+		t.Fatalf("expected sequence %d after recovery, got %d", e.Sequence(), recovered.Sequence())
+	}
+	want, got := e.books["SOL_USDC"].Orders(), recovered.books["SOL_USDC"].Orders()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d orders after recovery, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || !got[i].Filled.Equal(want[i].Filled) {
+			t.Fatalf("order %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+	for _, user := range []uuid.UUID{buyer, seller} {
+		for asset, balance := range e.funds.Balances(user) {
+			assertBalance(t, recovered, user, asset, balance.Available.String(), balance.Locked.String())
+		}
+	}
+
+	// The GTD order from before the snapshot is still scheduled to expire, and
+	// orders placed after it can be cancelled with their funds released.
+	recovered.ExpireDue(time.Now().Add(2 * time.Minute))
+	if _, ok := recovered.books["SOL_USDC"].Order(expiring.Data.(types.CreateOrderResponse).OrderID); ok {
+		t.Fatal("expected the GTD order to expire after restoring the snapshot")
+	}
+	orderID := resting.Data.(types.CreateOrderResponse).OrderID
+	if resp := command(t, recovered, buyer, CancelOrder, types.CancelOrderData{OrderID: orderID, Market: "SOL_USDC"}); !resp.Success {
+		t.Fatalf("could not cancel a recovered order: %s", resp.Message)
+	}
+	assertBalance(t, recovered, buyer, "USDC", "899", "0")
+}
+
+func TestLoadSnapshotFallsBackPastDamagedFile(t *testing.T) {
+	dir := t.TempDir()
+	e := New(markets.Default(), discard{})
+	user := uuid.New()
+
+	command(t, e, user, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(100)})
+	if _, err := e.SaveSnapshot(dir); err != nil {
+		t.Fatal(err)
+	}
+	command(t, e, user, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(50)})
+	newest, err := e.SaveSnapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(newest, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := New(markets.Default(), discard{})
+	loaded, err := restored.LoadSnapshot(dir)
+	if err != nil || loaded == newest {
+		t.Fatalf("expected to fall back to the older snapshot, got %q (%v)", loaded, err)
+	}
+	if restored.Sequence() != 1 {
+		t.Fatalf("expected sequence 1 from the older snapshot, got %d", restored.Sequence())
+	}
+	assertBalance(t, restored, user, "USDC", "100", "0")
+}
+
+func TestSnapshotsCompactTheJournal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "engine.wal")
+	log, err := wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New(markets.Default(), discard{}, WithJournal(log))
+	user := uuid.New()
+
+	var newest string
+	for _, amount := range []int64{100, 10, 1} {
+		command(t, e, user, OnRamp, types.OnRampData{Asset: "USDC", Amount: decimal.NewFromInt(amount)})
+		if newest, err = e.SaveSnapshot(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Close()
+
+	// Only what the older of the two snapshots kept does not cover is left.
+	var seqs []uint64
+	wal.ReplayFile(path, 0, func(seq uint64, _ []byte) error {
+		seqs = append(seqs, seq)
+		return nil
+	})
+	if len(seqs) != 1 || seqs[0] != 3 {
+		t.Fatalf("expected the journal to hold only entry 3, got %v", seqs)
+	}
+
+	// That is enough to recover from the older snapshot if the newest is lost.
+	if err := os.Remove(newest); err != nil {
+		t.Fatal(err)
+	}
+	log, err = wal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	recovered := New(markets.Default(), discard{}, WithJournal(log))
+	if _, err := recovered.LoadSnapshot(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	assertBalance(t, recovered, user, "USDC", "111", "0")
+
+	// Without any snapshot the journal is refused, not replayed onto an empty engine.
+	if err := New(markets.Default(), discard{}, WithJournal(log)).Recover(); err == nil {
+		t.Fatal("expected a compacted journal to be refused without its snapshot")
+	}
+}
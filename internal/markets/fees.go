@@ -0,0 +1,78 @@
+package markets
+
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// FeeTier is one VIP level. A user reaches it once their 30-day traded volume,
+// in quote terms across every market, is at least MinVolume. Levels are numbered
+// by their position in the markets file, starting at 0.
+type FeeTier struct {
+	MinVolume decimal.Decimal `json:"min_volume"`
+}
+
+// FeeRates are the fractions of the received amount charged on each trade,
+// e.g. 0.001 for 0.1%. Makers rest on the book, takers trade against it.
+type FeeRates struct {
+	Maker decimal.Decimal `json:"maker"`
+	Taker decimal.Decimal `json:"taker"`
+}
+
+// Rates returns the market's fee rates for a VIP level. Levels beyond the
+// market's schedule get its last entry; a market without a schedule charges nothing.
+func (m Market) Rates(level int) FeeRates {
+	if len(m.Fees) == 0 {
+		return FeeRates{}
+	}
+	if level < 0 {
+		level = 0
+	}
+	if level >= len(m.Fees) {
+		level = len(m.Fees) - 1
+	}
+	return m.Fees[level]
+}
+
+// Level returns the highest VIP level whose minimum volume the given volume reaches.
+func (r *Registry) Level(volume decimal.Decimal) int {
+	level := 0
+	for i, tier := range r.tiers {
+		if volume.GreaterThanOrEqual(tier.MinVolume) {
+			level = i
+		}
+	}
+	return level
+}
+
+// Tiers returns the VIP levels, lowest first.
+func (r *Registry) Tiers() []FeeTier {
+	return append([]FeeTier(nil), r.tiers...)
+}
+
+// setTiers validates and installs the VIP levels. The first level must start at
+// zero volume so that every user has one, and each later level needs more volume.
+func (r *Registry) setTiers(tiers []FeeTier) error {
+	for i, tier := range tiers {
+		if i == 0 && !tier.MinVolume.IsZero() {
+			return fmt.Errorf("fee tier 0 must have a min_volume of 0")
+		}
+		if i > 0 && !tier.MinVolume.GreaterThan(tiers[i-1].MinVolume) {
+			return fmt.Errorf("fee tier %d: min_volume must be greater than tier %d's", i, i-1)
+		}
+	}
+	r.tiers = tiers
+	return nil
+}
+
+// validateFees checks that a market's rates are fractions below one. Rebates are not supported.
+func validateFees(m Market) error {
+	one := decimal.NewFromInt(1)
+	for i, rates := range m.Fees {
+		if rates.Maker.IsNegative() || rates.Taker.IsNegative() || rates.Maker.GreaterThanOrEqual(one) || rates.Taker.GreaterThanOrEqual(one) {
+			return fmt.Errorf("market %q: fee level %d: maker and taker must be between 0 and 1", m.Symbol, i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package markets
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestLevelAndRates(t *testing.T) {
+	d := decimal.RequireFromString
+	r := &Registry{}
+	if err := r.setTiers([]FeeTier{{MinVolume: d("0")}, {MinVolume: d("1000")}, {MinVolume: d("5000")}}); err != nil {
+		t.Fatal(err)
+	}
+	for volume, want := range map[string]int{"0": 0, "999.99": 0, "1000": 1, "4999": 1, "5000": 2, "1000000": 2} {
+		if got := r.Level(d(volume)); got != want {
+			t.Errorf("volume %s: expected level %d, got %d", volume, want, got)
+		}
+	}
+
+	m := Market{Fees: []FeeRates{{Maker: d("0.001"), Taker: d("0.002")}, {Maker: d("0.0005"), Taker: d("0.001")}}}
+	if rates := m.Rates(2); !rates.Taker.Equal(d("0.001")) {
+		t.Errorf("levels past the schedule should get its last entry, got %+v", rates)
+	}
+	if rates := (Market{}).Rates(1); !rates.Maker.IsZero() || !rates.Taker.IsZero() {
+		t.Errorf("a market without fees should charge nothing, got %+v", rates)
+	}
+}
+
+func TestSetTiersRejectsBadSchedules(t *testing.T) {
+	d := decimal.RequireFromString
+	for name, tiers := range map[string][]FeeTier{
+		"first above zero": {{MinVolume: d("10")}},
+		"not increasing":   {{MinVolume: d("0")}, {MinVolume: d("100")}, {MinVolume: d("100")}},
+	} {
+		if err := (&Registry{}).setTiers(tiers); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package markets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// Status controls whether a market accepts new orders.
+type Status string
+
+const (
+	StatusActive Status = "active"
+	StatusHalted Status = "halted"
+)
+
+// defaultConfigPath is used when MARKETS_CONFIG is not set.
+const defaultConfigPath = "markets.json"
+
+// ErrUnknownMarket is returned when a symbol is not in the registry.
+var ErrUnknownMarket = errors.New("unknown market")
+
+// Market describes a tradable pair and the increments its orders must respect.
+type Market struct {
+	Symbol     string          `json:"symbol"` // e.g. "SOL_USDC"
+	BaseAsset  string          `json:"base_asset"`
+	QuoteAsset string          `json:"quote_asset"`
+	TickSize   decimal.Decimal `json:"tick_size"` // Smallest price increment
+	LotSize    decimal.Decimal `json:"lot_size"`  // Smallest quantity increment
+	Status     Status          `json:"status"`
+
+	MinQuantity decimal.Decimal `json:"min_quantity"` // Smallest base quantity per order
+	MaxQuantity decimal.Decimal `json:"max_quantity"` // Largest base quantity per order, zero for no limit
+	MinNotional decimal.Decimal `json:"min_notional"` // Smallest order value in the quote asset
+
+	// Fees holds the maker and taker rates for each VIP level, lowest level first.
+	// Levels past the end use the last entry. Empty means trading is free.
+	Fees []FeeRates `json:"fees"`
+}
+
+// Registry holds every market the exchange knows about, keyed by symbol.
+type Registry struct {
+	markets map[string]Market
+	symbols []string  // Sorted, so iteration order is stable
+	tiers   []FeeTier // VIP levels by 30-day volume, lowest first
+}
+
+// config is the on-disk layout of the markets file.
+type config struct {
+	FeeTiers []FeeTier `json:"fee_tiers"`
+	Markets  []Market  `json:"markets"`
+}
+
+// NewRegistry validates the given markets and indexes them by symbol.
+func NewRegistry(markets []Market) (*Registry, error) {
+	r := &Registry{markets: make(map[string]Market, len(markets))}
+	for _, m := range markets {
+		if m.Symbol == "" || m.BaseAsset == "" || m.QuoteAsset == "" {
+			return nil, fmt.Errorf("market %q: symbol, base_asset and quote_asset are required", m.Symbol)
+		}
+		if !m.TickSize.IsPositive() || !m.LotSize.IsPositive() {
+			return nil, fmt.Errorf("market %q: tick_size and lot_size must be positive", m.Symbol)
+		}
+		if m.MinQuantity.IsNegative() || m.MaxQuantity.IsNegative() || m.MinNotional.IsNegative() {
+			return nil, fmt.Errorf("market %q: min_quantity, max_quantity and min_notional must not be negative", m.Symbol)
+		}
+		if m.MaxQuantity.IsPositive() && m.MaxQuantity.LessThan(m.MinQuantity) {
+			return nil, fmt.Errorf("market %q: max_quantity is below min_quantity", m.Symbol)
+		}
+		if err := validateFees(m); err != nil {
+			return nil, err
+		}
+		if _, dup := r.markets[m.Symbol]; dup {
+			return nil, fmt.Errorf("market %q is defined more than once", m.Symbol)
+		}
+		if m.Status == "" {
+			m.Status = StatusActive
+		}
+		r.markets[m.Symbol] = m
+		r.symbols = append(r.symbols, m.Symbol)
+	}
+	sort.Strings(r.symbols)
+	return r, nil
+}
+
+// Default returns a registry with the single market the exchange started with.
+func Default() *Registry {
+	r, _ := NewRegistry([]Market{{
+		Symbol:     "SOL_USDC",
+		BaseAsset:  "SOL",
+		QuoteAsset: "USDC",
+		TickSize:   decimal.RequireFromString("0.01"),
+		LotSize:    decimal.RequireFromString("0.01"),
+		Status:     StatusActive,
+
+		MinQuantity: decimal.RequireFromString("0.01"),
+		MinNotional: decimal.NewFromInt(1),
+	}})
+	return r
+}
+
+// Load reads a registry from a JSON markets file.
+func Load(path string) (*Registry, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	r, err := NewRegistry(cfg.Markets)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.setTiers(cfg.FeeTiers); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// LoadFromEnv loads the file named by MARKETS_CONFIG, falling back to
+// markets.json. If neither exists the default registry is returned.
+func LoadFromEnv() (*Registry, error) {
+	path := os.Getenv("MARKETS_CONFIG")
+	if path == "" {
+		path = defaultConfigPath
+	}
+	r, err := Load(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Default(), nil
+	}
+	return r, err
+}
+
+// Get looks up a market by symbol.
+func (r *Registry) Get(symbol string) (Market, error) {
+	m, ok := r.markets[symbol]
+	if !ok {
+		return Market{}, fmt.Errorf("%w: %s", ErrUnknownMarket, symbol)
+	}
+	return m, nil
+}
+
+// All returns every market ordered by symbol.
+func (r *Registry) All() []Market {
+	all := make([]Market, 0, len(r.symbols))
+	for _, symbol := range r.symbols {
+		all = append(all, r.markets[symbol])
+	}
+	return all
+}
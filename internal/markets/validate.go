@@ -0,0 +1,140 @@
+package markets
+
+import (
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/shopspring/decimal"
+)
+
+// Error codes returned to clients when an order breaks a market's trading rules.
+const (
+	CodeInvalidPrice       = "INVALID_PRICE"
+	CodeInvalidQuantity    = "INVALID_QUANTITY"
+	CodePriceTickSize      = "PRICE_NOT_MULTIPLE_OF_TICK_SIZE"
+	CodeQuantityLotSize    = "QUANTITY_NOT_MULTIPLE_OF_LOT_SIZE"
+	CodeQuantityTooSmall   = "QUANTITY_BELOW_MINIMUM"
+	CodeQuantityTooLarge   = "QUANTITY_ABOVE_MAXIMUM"
+	CodeNotionalTooSmall   = "NOTIONAL_BELOW_MINIMUM"
+	CodeMarketNotTradeable = "MARKET_NOT_ACCEPTING_ORDERS"
+	CodeUnknownMarket      = "UNKNOWN_MARKET"
+)
+
+// ValidationError reports a broken trading rule with a stable code clients can act on.
+type ValidationError struct {
+	Code    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func invalid(code, message string) *ValidationError {
+	return &ValidationError{Code: code, Message: message}
+}
+
+// ValidateOrder checks a new order's prices and sizes against the market's tick size,
+// lot size, quantity limits and minimum notional. Fields the order does not use
+// should be left zero; those its type needs must be set. The notional of a market
+// order given in base quantity is not known until it trades, so only
+// quote-denominated market orders are checked for it.
+func (m Market) ValidateOrder(data types.CreateOrderData) error {
+	if m.Status != StatusActive {
+		return invalid(CodeMarketNotTradeable, "market "+m.Symbol+" is not accepting orders")
+	}
+	if err := checkRequired(data); err != nil {
+		return err
+	}
+	if err := m.checkPrice("price", data.Price); err != nil {
+		return err
+	}
+	if err := m.checkPrice("stop_price", data.StopPrice); err != nil {
+		return err
+	}
+	if err := m.checkQuantity("quantity", data.Quantity); err != nil {
+		return err
+	}
+	if data.DisplayQuantity.IsNegative() {
+		return invalid(CodeInvalidQuantity, "display_quantity must be positive")
+	}
+	if !data.DisplayQuantity.Mod(m.LotSize).IsZero() {
+		return invalid(CodeQuantityLotSize, "display_quantity must be a multiple of lot size "+m.LotSize.String())
+	}
+	if data.QuoteQuantity.IsNegative() {
+		return invalid(CodeInvalidQuantity, "quote_quantity must be positive")
+	}
+
+	// Limit orders trade at their price or better, stop-market orders at roughly their stop price.
+	price := data.Price
+	if price.IsZero() {
+		price = data.StopPrice
+	}
+	notional := data.QuoteQuantity
+	if notional.IsZero() {
+		notional = price.Mul(data.Quantity)
+	}
+	if notional.IsPositive() && notional.LessThan(m.MinNotional) {
+		return invalid(CodeNotionalTooSmall, "order value must be at least "+m.MinNotional.String()+" "+m.QuoteAsset)
+	}
+	return nil
+}
+
+// ValidateAmend checks the new price and quantity of an amend. Zero values are
+// left unchanged by the amend and so are not checked.
+func (m Market) ValidateAmend(data types.AmendOrderData) error {
+	if m.Status != StatusActive {
+		return invalid(CodeMarketNotTradeable, "market "+m.Symbol+" is not accepting orders")
+	}
+	if err := m.checkPrice("price", data.Price); err != nil {
+		return err
+	}
+	return m.checkQuantity("quantity", data.Quantity)
+}
+
+// checkRequired rejects an order missing a price or size its type needs. Zero
+// means unused everywhere else, so a zero here would otherwise pass.
+func checkRequired(data types.CreateOrderData) error {
+	isMarket := data.Type == types.Market || data.Type == types.StopMarket
+	isStop := data.Type == types.StopMarket || data.Type == types.StopLimit
+	switch {
+	case !isMarket && !data.Price.IsPositive():
+		return invalid(CodeInvalidPrice, "price must be positive")
+	case isStop && !data.StopPrice.IsPositive():
+		return invalid(CodeInvalidPrice, "stop_price must be positive")
+	case !isMarket && !data.Quantity.IsPositive():
+		return invalid(CodeInvalidQuantity, "quantity must be positive")
+	case isMarket && !data.Quantity.IsPositive() && !data.QuoteQuantity.IsPositive():
+		return invalid(CodeInvalidQuantity, "quantity or quote_quantity must be positive")
+	}
+	return nil
+}
+
+// checkPrice allows zero, meaning the field is unused, but otherwise requires
+// a positive multiple of the tick size.
+func (m Market) checkPrice(field string, price decimal.Decimal) error {
+	if price.IsNegative() {
+		return invalid(CodeInvalidPrice, field+" must be positive")
+	}
+	if !price.Mod(m.TickSize).IsZero() {
+		return invalid(CodePriceTickSize, field+" must be a multiple of tick size "+m.TickSize.String())
+	}
+	return nil
+}
+
+// checkQuantity allows zero, meaning the field is unused, but otherwise requires
+// a positive multiple of the lot size within the market's quantity limits.
+func (m Market) checkQuantity(field string, qty decimal.Decimal) error {
+	switch {
+	case qty.IsZero():
+		return nil
+	case qty.IsNegative():
+		return invalid(CodeInvalidQuantity, field+" must be positive")
+	case !qty.Mod(m.LotSize).IsZero():
+		return invalid(CodeQuantityLotSize, field+" must be a multiple of lot size "+m.LotSize.String())
+	case qty.LessThan(m.MinQuantity):
+		return invalid(CodeQuantityTooSmall, field+" must be at least "+m.MinQuantity.String())
+	case m.MaxQuantity.IsPositive() && qty.GreaterThan(m.MaxQuantity):
+		return invalid(CodeQuantityTooLarge, field+" must be at most "+m.MaxQuantity.String())
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package markets
+
+import (
+	"testing"
+
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestValidateOrderReportsRuleCodes(t *testing.T) {
+	market := Market{
+		Symbol:      "SOL_USDC",
+		QuoteAsset:  "USDC",
+		TickSize:    decimal.RequireFromString("0.01"),
+		LotSize:     decimal.RequireFromString("0.1"),
+		Status:      StatusActive,
+		MinQuantity: decimal.RequireFromString("0.1"),
+		MaxQuantity: decimal.NewFromInt(100),
+		MinNotional: decimal.NewFromInt(10),
+	}
+	d := decimal.RequireFromString
+
+	tests := []struct {
+		name  string
+		order types.CreateOrderData
+		code  string
+	}{
+		{"valid limit", types.CreateOrderData{Price: d("25.5"), Quantity: d("1")}, ""},
+		{"negative price", types.CreateOrderData{Price: d("-1"), Quantity: d("1")}, CodeInvalidPrice},
+		{"zero price", types.CreateOrderData{Quantity: d("1")}, CodeInvalidPrice},
+		{"stop limit without price", types.CreateOrderData{Type: types.StopLimit, StopPrice: d("25"), Quantity: d("1")}, CodeInvalidPrice},
+		{"stop without stop price", types.CreateOrderData{Type: types.StopMarket, Quantity: d("1")}, CodeInvalidPrice},
+		{"price off tick", types.CreateOrderData{Price: d("25.505"), Quantity: d("1")}, CodePriceTickSize},
+		{"stop price off tick", types.CreateOrderData{Type: types.StopMarket, StopPrice: d("25.001"), Quantity: d("1")}, CodePriceTickSize},
+		{"negative quantity", types.CreateOrderData{Price: d("25"), Quantity: d("-1")}, CodeInvalidQuantity},
+		{"zero quantity", types.CreateOrderData{Price: d("25")}, CodeInvalidQuantity},
+		{"market without size", types.CreateOrderData{Type: types.Market}, CodeInvalidQuantity},
+		{"quantity off lot", types.CreateOrderData{Price: d("25"), Quantity: d("1.05")}, CodeQuantityLotSize},
+		{"quantity too large", types.CreateOrderData{Price: d("25"), Quantity: d("100.1")}, CodeQuantityTooLarge},
+		{"notional too small", types.CreateOrderData{Price: d("25"), Quantity: d("0.3")}, CodeNotionalTooSmall},
+		{"quote notional too small", types.CreateOrderData{Type: types.Market, QuoteQuantity: d("5")}, CodeNotionalTooSmall},
+		{"market by base quantity", types.CreateOrderData{Type: types.Market, Quantity: d("0.1")}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := market.ValidateOrder(tt.order)
+			if tt.code == "" {
+				if err != nil {
+					t.Fatalf("expected order to be valid, got %v", err)
+				}
+				return
+			}
+			invalid, ok := err.(*ValidationError)
+			if !ok || invalid.Code != tt.code {
+				t.Fatalf("expected code %s, got %v", tt.code, err)
+			}
+		})
+	}
+
+	market.Status = StatusHalted
+	if err := market.ValidateOrder(tests[0].order); err == nil {
+		t.Fatal("expected a halted market to reject orders")
+	}
+}
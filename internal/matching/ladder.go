@@ -0,0 +1,122 @@
+package matching
+
+import "github.com/shopspring/decimal"
+
+// maxHeight bounds the skiplist towers. With a promotion probability of 1/4,
+// 16 levels comfortably index billions of price levels.
+const maxHeight = 16
+
+type ladderNode struct {
+	level *priceLevel
+	next  []*ladderNode
+}
+
+// priceLadder is a skiplist of price levels ordered best price first.
+// Lookups, inserts and deletes are O(log n); the best level is O(1).
+type priceLadder struct {
+	head   *ladderNode
+	height int
+	length int
+	better func(a, b decimal.Decimal) bool // Reports whether a should come before b
+	rnd    uint64                          // xorshift state; fixed seed keeps layouts reproducible
+}
+
+func newPriceLadder(better func(a, b decimal.Decimal) bool) *priceLadder {
+	return &priceLadder{
+		head:   &ladderNode{next: make([]*ladderNode, maxHeight)},
+		height: 1,
+		better: better,
+		rnd:    0x9E3779B97F4A7C15,
+	}
+}
+
+func (l *priceLadder) randomHeight() int {
+	height := 1
+	for height < maxHeight {
+		l.rnd ^= l.rnd << 13
+		l.rnd ^= l.rnd >> 7
+		l.rnd ^= l.rnd << 17
+		if l.rnd&3 != 0 {
+			break
+		}
+		height++
+	}
+	return height
+}
+
+// seek fills update with the last node before price on every level.
+func (l *priceLadder) seek(price decimal.Decimal, update *[maxHeight]*ladderNode) *ladderNode {
+	x := l.head
+	for i := l.height - 1; i >= 0; i-- {
+		for x.next[i] != nil && l.better(x.next[i].level.price, price) {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// get returns the level at price, or nil if there is none.
+func (l *priceLadder) get(price decimal.Decimal) *priceLevel {
+	x := l.seek(price, nil)
+	if x != nil && x.level.price.Equal(price) {
+		return x.level
+	}
+	return nil
+}
+
+// insert adds a level whose price is not yet in the ladder.
+func (l *priceLadder) insert(level *priceLevel) {
+	var update [maxHeight]*ladderNode
+	l.seek(level.price, &update)
+
+	height := l.randomHeight()
+	for i := l.height; i < height; i++ {
+		update[i] = l.head
+	}
+	if height > l.height {
+		l.height = height
+	}
+
+	node := &ladderNode{level: level, next: make([]*ladderNode, height)}
+	for i := 0; i < height; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	l.length++
+}
+
+// delete removes the level at price if present.
+func (l *priceLadder) delete(price decimal.Decimal) {
+	var update [maxHeight]*ladderNode
+	x := l.seek(price, &update)
+	if x == nil || !x.level.price.Equal(price) {
+		return
+	}
+	for i := 0; i < l.height && update[i].next[i] == x; i++ {
+		update[i].next[i] = x.next[i]
+	}
+	for l.height > 1 && l.head.next[l.height-1] == nil {
+		l.height--
+	}
+	l.length--
+}
+
+// best returns the level with the best price, or nil if the ladder is empty.
+func (l *priceLadder) best() *priceLevel {
+	if first := l.head.next[0]; first != nil {
+		return first.level
+	}
+	return nil
+}
+
+// each visits levels best price first until fn returns false.
+func (l *priceLadder) each(fn func(level *priceLevel) bool) {
+	for x := l.head.next[0]; x != nil; x = x.next[0] {
+		if !fn(x.level) {
+			return
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package matching
+
+import (
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// taker tracks how much more an incoming order is willing to trade, and at what prices.
+type taker struct {
+	order   *types.Order
+	worst   *decimal.Decimal // Worst acceptable price, nil to accept any price
+	quote   *decimal.Decimal // Remaining quote budget for quote-denominated orders, nil otherwise
+	spent   bool             // The quote budget no longer covers a lot at the best price
+	funds   *decimal.Decimal // Remaining balance a market order may spend, nil for no cap
+	broke   bool             // The funds no longer cover a lot at the best price
+	lotSize decimal.Decimal
+
+	makers []*types.Order // Resting orders traded against, each once, in order of first fill
+
+	cancelled         bool           // Self-trade prevention cancelled the rest of the order
+	makersCancelled   []types.Order  // Resting orders cancelled by self-trade prevention
+	makersDecremented []*types.Order // Resting orders shrunk by decrement-and-cancel that still rest
+}
+
+// appendOnce appends order to orders unless it is already there.
+func appendOnce(orders []*types.Order, order *types.Order) []*types.Order {
+	for _, seen := range orders {
+		if seen == order {
+			return orders
+		}
+	}
+	return append(orders, order)
+}
+
+// accepts reports whether the taker is willing to trade at price.
+func (t *taker) accepts(price decimal.Decimal) bool {
+	if t.worst == nil {
+		return true
+	}
+	if t.order.Side == types.Buy {
+		return t.worst.GreaterThanOrEqual(price)
+	}
+	return t.worst.LessThanOrEqual(price)
+}
+
+// wants returns the base quantity the taker still wants to trade at price.
+func (t *taker) wants(price decimal.Decimal) decimal.Decimal {
+	if t.quote == nil {
+		return t.order.Remaining()
+	}
+	qty := t.quote.Div(price)
+	if t.lotSize.IsPositive() {
+		return qty.Div(t.lotSize).Floor().Mul(t.lotSize)
+	}
+	return qty
+}
+
+// affordable caps qty at what the taker's funds pay for at price:
+// quote for a buy, base for a sell.
+func (t *taker) affordable(qty, price decimal.Decimal) decimal.Decimal {
+	if t.funds == nil {
+		return qty
+	}
+	limit := *t.funds
+	if t.order.Side == types.Buy {
+		limit = limit.Div(price)
+		if t.lotSize.IsPositive() {
+			limit = limit.Div(t.lotSize).Floor().Mul(t.lotSize)
+		}
+	}
+	return decimal.Min(qty, limit)
+}
+
+// fill records qty traded at price against the taker.
+func (t *taker) fill(qty, price decimal.Decimal) {
+	t.order.Filled = t.order.Filled.Add(qty)
+	if t.quote != nil {
+		spent := t.quote.Sub(qty.Mul(price))
+		t.quote = &spent
+	}
+	t.pay(qty, price)
+}
+
+// pay takes what trading qty at price costs out of the taker's funds, if capped.
+func (t *taker) pay(qty, price decimal.Decimal) {
+	if t.funds == nil {
+		return
+	}
+	cost := qty
+	if t.order.Side == types.Buy {
+		cost = qty.Mul(price)
+	}
+	left := t.funds.Sub(cost)
+	t.funds = &left
+}
+
+// decrement removes qty at price from the taker without trading it,
+// as decrement-and-cancel self-trade prevention requires.
+func (t *taker) decrement(qty, price decimal.Decimal) {
+	if t.quote != nil {
+		left := t.quote.Sub(qty.Mul(price))
+		t.quote = &left
+		return
+	}
+	t.order.Quantity = t.order.Quantity.Sub(qty)
+}
+
+// satisfied reports whether the taker has nothing left to trade. A quote budget
+// counts as spent once it cannot afford a single lot, so dust does not linger.
+func (t *taker) satisfied() bool {
+	if t.quote == nil {
+		return !t.order.Remaining().IsPositive()
+	}
+	return t.spent || !t.quote.IsPositive()
+}
+
+// match fills the incoming order against the opposite side of the book,
+// best price first and earliest arrival first within a price.
+func (ob *Orderbook) match(t *taker) []types.Fill {
+	fills := make([]types.Fill, 0)
+	order := t.order
+
+	opposite := ob.asks
+	if order.Side == types.Sell {
+		opposite = ob.bids
+	}
+
+	for !t.satisfied() && !t.cancelled && !t.broke {
+		level := opposite.best()
+		if level == nil || !t.accepts(level.price) {
+			break
+		}
+
+		for node := level.head; node != nil && !t.cancelled; {
+			want := t.wants(level.price)
+			if !want.IsPositive() {
+				t.spent = t.quote != nil
+				break
+			}
+			if want = t.affordable(want, level.price); !want.IsPositive() {
+				t.broke = true
+				break
+			}
+			next := node.next
+			matchedOrder := node.order
+
+			if matchedOrder.UserID == order.UserID && order.SelfTradePrevention != "" {
+				ob.preventSelfTrade(t, node, want)
+				node = next
+				continue
+			}
+
+			qtyToFill := decimal.Min(want, visibleQty(matchedOrder))
+			t.fill(qtyToFill, matchedOrder.Price)
+			t.makers = appendOnce(t.makers, matchedOrder)
+			matchedOrder.Filled = matchedOrder.Filled.Add(qtyToFill)
+			if isIceberg(matchedOrder) {
+				matchedOrder.Visible = matchedOrder.Visible.Sub(qtyToFill)
+			}
+			level.volume = level.volume.Sub(qtyToFill)
+			updateStatus(matchedOrder)
+			ob.lastPrice = matchedOrder.Price
+			ob.tradeID++
+
+			fills = append(fills, types.Fill{
+				Qty:          qtyToFill,
+				Price:        matchedOrder.Price,
+				TradeID:      ob.tradeID,
+				Timestamp:    ob.now().UnixMilli(),
+				MakerOrderID: matchedOrder.ID,
+				MakerUserID:  matchedOrder.UserID,
+				TakerOrderID: order.ID,
+				TakerUserID:  order.UserID,
+				TakerSide:    order.Side,
+			})
+
+			if matchedOrder.Filled.Equal(matchedOrder.Quantity) {
+				ob.remove(node)
+			} else if isIceberg(matchedOrder) && matchedOrder.Visible.IsZero() {
+				ob.replenish(node)
+			}
+			node = next
+		}
+	}
+	return fills
+}
+
+// preventSelfTrade resolves a match between two orders from the same user
+// according to the incoming order's self-trade prevention mode.
+func (ob *Orderbook) preventSelfTrade(t *taker, node *orderNode, want decimal.Decimal) {
+	resting := node.order
+
+	switch t.order.SelfTradePrevention {
+	case types.CancelNewest:
+		t.cancelled = true
+
+	case types.CancelOldest:
+		ob.cancelResting(t, node)
+
+	case types.CancelBoth:
+		ob.cancelResting(t, node)
+		t.cancelled = true
+
+	case types.DecrementAndCancel:
+		// Both orders shrink by the overlap; whichever reaches zero is cancelled.
+		qty := decimal.Min(want, visibleQty(resting))
+		t.decrement(qty, resting.Price)
+		resting.Quantity = resting.Quantity.Sub(qty)
+		if isIceberg(resting) {
+			resting.Visible = resting.Visible.Sub(qty)
+		}
+		node.level.volume = node.level.volume.Sub(qty)
+
+		if !resting.Remaining().IsPositive() {
+			ob.cancelResting(t, node)
+		} else {
+			if isIceberg(resting) && resting.Visible.IsZero() {
+				ob.replenish(node)
+			}
+			t.makersDecremented = appendOnce(t.makersDecremented, resting)
+		}
+		if t.quote == nil && !t.order.Remaining().IsPositive() {
+			t.cancelled = true
+		}
+	}
+}
+
+// replenish refreshes an iceberg order's visible slice from its hidden quantity.
+// The refreshed slice goes to the back of the queue, losing its time priority.
+func (ob *Orderbook) replenish(node *orderNode) {
+	order := node.order
+	level := node.level
+	level.unlink(node)
+
+	order.Visible = decimal.Min(order.DisplayQuantity, order.Remaining())
+	ob.seq++
+	order.Seq = ob.seq
+	level.push(node)
+}
+
+// cancelResting takes a resting order off the book on behalf of self-trade prevention.
+func (ob *Orderbook) cancelResting(t *taker, node *orderNode) {
+	ob.remove(node)
+	node.order.Status = types.StatusCancelled
+	t.makersCancelled = append(t.makersCancelled, *node.order)
+}
+
+// postOnlyPrice returns the price a post-only order may rest at without
+// crossing the spread, repricing it one tick behind the best opposite price if asked to.
+func (ob *Orderbook) postOnlyPrice(side types.OrderSide, price decimal.Decimal, reprice bool) (decimal.Decimal, error) {
+	if side == types.Buy {
+		best := ob.asks.best()
+		if best == nil || price.LessThan(best.price) {
+			return price, nil
+		}
+		if reprice && ob.tickSize.IsPositive() {
+			if repriced := best.price.Sub(ob.tickSize); repriced.IsPositive() {
+				return repriced, nil
+			}
+		}
+		return price, ErrPostOnlyWouldCross
+	}
+
+	best := ob.bids.best()
+	if best == nil || price.GreaterThan(best.price) {
+		return price, nil
+	}
+	if reprice && ob.tickSize.IsPositive() {
+		return best.price.Add(ob.tickSize), nil
+	}
+	return price, ErrPostOnlyWouldCross
+}
+
+// available sums the opposite side's resting quantity the taker would trade,
+// stopping as soon as it covers the taker's quantity or exhausts its funds.
+func (ob *Orderbook) available(t *taker) decimal.Decimal {
+	opposite := ob.asks
+	if t.order.Side == types.Sell {
+		opposite = ob.bids
+	}
+	// Price the levels against a copy of the funds so the taker's own are left untouched.
+	budget := &taker{order: t.order, lotSize: t.lotSize}
+	if t.funds != nil {
+		funds := *t.funds
+		budget.funds = &funds
+	}
+
+	total := decimal.Zero
+	opposite.each(func(level *priceLevel) bool {
+		if !t.accepts(level.price) {
+			return false
+		}
+		qty, more := decimal.Zero, true
+		own := ownOrder(level, t.order.UserID)
+		switch {
+		case t.order.SelfTradePrevention == "" || own == nil:
+			qty = level.volume.Add(level.hidden)
+		case t.order.SelfTradePrevention == types.CancelOldest:
+			// The user's own orders are cancelled rather than traded with, so they do not count.
+			for node := level.head; node != nil; node = node.next {
+				if node.order.UserID != t.order.UserID {
+					qty = qty.Add(node.order.Remaining())
+				}
+			}
+		default:
+			// Every other mode cancels or shrinks the taker when it reaches the
+			// user's own order, so only what trades ahead of it counts. Icebergs
+			// ahead of it refill behind it, so only their visible slice does.
+			for node := level.head; node != own; node = node.next {
+				qty = qty.Add(visibleQty(node.order))
+			}
+			more = false
+		}
+		if affordable := budget.affordable(qty, level.price); affordable.LessThan(qty) {
+			// A market order trades no more than its funds pay for, however deep the book.
+			qty, more = affordable, false
+		}
+		budget.pay(qty, level.price)
+		total = total.Add(qty)
+		return more && total.LessThan(t.order.Quantity)
+	})
+	return total
+}
+
+// ownOrder returns the first order at a level that belongs to user, or nil.
+func ownOrder(level *priceLevel, user uuid.UUID) *orderNode {
+	for node := level.head; node != nil; node = node.next {
+		if node.order.UserID == user {
+			return node
+		}
+	}
+	return nil
+}
+
+// slippageBound returns the worst price a market order may trade at, measured
+// from the best opposite price when it arrives. It returns nil when unbounded.
+func (ob *Orderbook) slippageBound(side types.OrderSide, maxSlippage decimal.Decimal) *decimal.Decimal {
+	if !maxSlippage.IsPositive() {
+		return nil
+	}
+	opposite, factor := ob.asks, decimal.NewFromInt(1).Add(maxSlippage)
+	if side == types.Sell {
+		opposite, factor = ob.bids, decimal.NewFromInt(1).Sub(maxSlippage)
+	}
+	best := opposite.best()
+	if best == nil {
+		return nil
+	}
+	bound := best.price.Mul(factor)
+	return &bound
+}
+
+// updateStatus derives a resting order's status from how much of it has filled.
+func updateStatus(order *types.Order) {
+	switch {
+	case order.Filled.IsZero():
+		order.Status = types.StatusNew
+	case order.Filled.LessThan(order.Quantity):
+		order.Status = types.StatusPartiallyFilled
+	default:
+		order.Status = types.StatusFilled
+	}
+}
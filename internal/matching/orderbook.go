@@ -1,7 +1,7 @@
 package matching
 
 import (
-	"sort"
+	"errors"
 	"sync"
 	"time"
 
@@ -11,217 +11,418 @@ import (
 	"github.com/shopspring/decimal"
 )
 
+var (
+	// ErrOrderNotFound is returned when an order is not resting on the book.
+	ErrOrderNotFound = errors.New("order not found")
+	// ErrNotOrderOwner is returned when a user tries to act on someone else's order.
+	ErrNotOrderOwner = errors.New("order belongs to another user")
+	// ErrPostOnlyWouldCross is returned when a post-only order would take liquidity.
+	ErrPostOnlyWouldCross = errors.New("post-only order would cross the spread")
+	// ErrInvalidAmend is returned when an amend would not leave a positive quantity to trade.
+	ErrInvalidAmend = errors.New("amended quantity must be greater than the filled quantity")
+	// ErrStopWouldTrigger is returned when a stop order's price has already been reached.
+	ErrStopWouldTrigger = errors.New("stop price has already been reached")
+)
+
+// CodePostOnlyWouldCross is the response code for post-only orders rejected with ErrPostOnlyWouldCross.
+const CodePostOnlyWouldCross = "POST_ONLY_WOULD_CROSS"
+
 // Orderbook matches buy and sell orders for a single market.
+//
+// Each side is a skiplist of price levels ordered best price first, and each
+// level is a FIFO linked list of orders. Every resting order is also indexed
+// by ID, so adding, cancelling and matching never scan the whole book.
+//
+// Stop orders wait in a separate trigger book with the same layout, keyed by
+// stop price, until the last trade price reaches them.
 type Orderbook struct {
-	mu        sync.RWMutex
-	market    string
-	bids      map[string]*types.Order // Using order ID as key for easy access
-	asks      map[string]*types.Order // Using order ID as key
-	bidPrices []decimal.Decimal       // Sorted list of bid prices (high to low)
-	askPrices []decimal.Decimal       // Sorted list of ask prices (low to high)
+	mu       sync.RWMutex
+	market   string
+	tickSize decimal.Decimal          // Smallest price increment, used to reprice post-only orders
+	lotSize  decimal.Decimal          // Smallest tradable quantity, zero if unrestricted
+	bids     *priceLadder             // Highest price first
+	asks     *priceLadder             // Lowest price first
+	orders   map[uuid.UUID]*orderNode // Every resting order by ID
+	seq      uint64                   // Arrival sequence of the last accepted order
+	tradeID  uint64                   // ID of the last trade, counting up from 1 per market
+
+	buyStops  *priceLadder             // Lowest stop price first, as a rising price reaches it first
+	sellStops *priceLadder             // Highest stop price first
+	stops     map[uuid.UUID]*orderNode // Every untriggered stop order by ID
+	lastPrice decimal.Decimal          // Price of the most recent trade, zero before the first
+
+	now   func() time.Time // Clock that stamps each trade
+	newID func() uuid.UUID // Gives an ID to each order that arrives without one
+}
+
+// Option configures an Orderbook.
+type Option func(*Orderbook)
+
+// WithTickSize sets the price increment post-only orders are repriced by.
+func WithTickSize(tick decimal.Decimal) Option {
+	return func(ob *Orderbook) { ob.tickSize = tick }
+}
+
+// WithLotSize rounds quantities derived by the book, such as the base quantity
+// a quote-denominated market order can afford, down to multiples of lot.
+func WithLotSize(lot decimal.Decimal) Option {
+	return func(ob *Orderbook) { ob.lotSize = lot }
+}
+
+// WithClock makes the book stamp trades with the time now returns instead of
+// the wall clock, so that replaying the same orders gives the same fills.
+func WithClock(now func() time.Time) Option {
+	return func(ob *Orderbook) { ob.now = now }
+}
+
+// WithIDGenerator makes the book give orders that arrive without an ID one
+// from newID instead of a random UUID.
+func WithIDGenerator(newID func() uuid.UUID) Option {
+	return func(ob *Orderbook) { ob.newID = newID }
 }
 
 // NewOrderbook creates a new orderbook for a given market.
-func NewOrderbook(market string) *Orderbook {
-	return &Orderbook{
-		market:    market,
-		bids:      make(map[string]*types.Order),
-		asks:      make(map[string]*types.Order),
-		bidPrices: make([]decimal.Decimal, 0),
-		askPrices: make([]decimal.Decimal, 0),
+func NewOrderbook(market string, opts ...Option) *Orderbook {
+	ob := &Orderbook{
+		market: market,
+		bids:   newPriceLadder(decimal.Decimal.GreaterThan),
+		asks:   newPriceLadder(decimal.Decimal.LessThan),
+		orders: make(map[uuid.UUID]*orderNode),
+
+		buyStops:  newPriceLadder(decimal.Decimal.LessThan),
+		sellStops: newPriceLadder(decimal.Decimal.GreaterThan),
+		stops:     make(map[uuid.UUID]*orderNode),
+
+		now:   time.Now,
+		newID: uuid.New,
 	}
+	for _, opt := range opts {
+		opt(ob)
+	}
+	return ob
+}
+
+// AddResult describes everything that happened when an order was added to the book.
+type AddResult struct {
+	Order       types.Order   // The incoming order after matching
+	Fills       []types.Fill  // Trades against resting orders, in execution order
+	Makers      []types.Order // Resting orders the fills traded against, as they stand after matching
+	Cancelled   []types.Order // Resting orders cancelled by self-trade prevention
+	Decremented []types.Order // Resting orders shrunk by self-trade prevention, still on the book
+	Triggered   []AddResult   // Stop orders activated by these fills, in activation order
 }
 
 // AddOrder adds a new order to the book and attempts to match it.
-func (ob *Orderbook) AddOrder(orderData types.CreateOrderData) []types.Fill {
+// A post-only order that would take liquidity is rejected with ErrPostOnlyWouldCross.
+// Stop orders are held in the trigger book until the last trade price reaches them.
+func (ob *Orderbook) AddOrder(orderData types.CreateOrderData) (AddResult, error) {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
+	if orderData.PostOnly {
+		price, err := ob.postOnlyPrice(orderData.Side, orderData.Price, orderData.PostOnlyReprice)
+		if err != nil {
+			return AddResult{}, err
+		}
+		orderData.Price = price
+	}
+
 	order := &types.Order{
-		ID:       uuid.New(),
-		UserID:   orderData.UserID,
-		Side:     orderData.Side,
-		Price:    orderData.Price,
-		Quantity: orderData.Quantity,
-		Filled:   decimal.Zero,
+		ID:        orderData.OrderID,
+		UserID:    orderData.UserID,
+		Side:      orderData.Side,
+		Type:      orderData.Type,
+		Price:     orderData.Price,
+		StopPrice: orderData.StopPrice,
+		Quantity:  orderData.Quantity,
+		Filled:    decimal.Zero,
+		Status:    types.StatusNew,
+
+		TimeInForce:         orderData.TimeInForce,
+		ExpireAt:            orderData.ExpireAt,
+		SelfTradePrevention: orderData.SelfTradePrevention,
+		PostOnly:            orderData.PostOnly,
+		PostOnlyReprice:     orderData.PostOnlyReprice,
+		DisplayQuantity:     orderData.DisplayQuantity,
+	}
+	if order.ID == uuid.Nil {
+		order.ID = ob.newID()
+	}
+	if order.Type == "" {
+		order.Type = types.Limit
 	}
+	if order.TimeInForce == "" {
+		order.TimeInForce = types.GTC
+	}
+	if order.TimeInForce != types.GTD {
+		order.ExpireAt = 0
+	}
+
+	node := &orderNode{order: order, maxSlippage: orderData.MaxSlippage, quoteQuantity: orderData.QuoteQuantity, funds: orderData.Funds}
+	if isStop(order.Type) {
+		if ob.reached(order.Side, order.StopPrice) {
+			return AddResult{}, ErrStopWouldTrigger
+		}
+		ob.seq++
+		order.Seq = ob.seq
+		order.Status = types.StatusUntriggered
+		ob.addStop(node)
+		return AddResult{Order: *order, Fills: make([]types.Fill, 0)}, nil
+	}
+
+	result := ob.execute(node)
+	result.Triggered = ob.activateStops()
+	return result, nil
+}
 
-	var fills []types.Fill
+// execute matches an order that is ready to trade and rests whatever is left
+// if its type and time in force allow it.
+func (ob *Orderbook) execute(node *orderNode) AddResult {
+	order := node.order
+	ob.seq++
+	order.Seq = ob.seq
 
-	if order.Side == types.Buy {
-		fills = ob.matchBid(order)
+	t := &taker{order: order, lotSize: ob.lotSize}
+	if isMarket(order.Type) {
+		order.Price = decimal.Zero
+		t.worst = ob.slippageBound(order.Side, node.maxSlippage)
+		if node.quoteQuantity.IsPositive() {
+			budget := node.quoteQuantity
+			t.quote = &budget
+			order.Quantity = decimal.Zero
+		}
+		if node.funds.IsPositive() {
+			funds := node.funds
+			t.funds = &funds
+		}
 	} else {
-		fills = ob.matchAsk(order)
+		t.worst = &order.Price
 	}
 
-	// If the order is not fully filled, add it to the book.
-	if order.Quantity.GreaterThan(order.Filled) {
+	// A fill-or-kill order that cannot be filled completely is killed before it touches the book.
+	if order.TimeInForce == types.FOK && ob.available(t).LessThan(order.Quantity) {
+		order.Status = types.StatusCancelled
+		return AddResult{Order: *order, Fills: make([]types.Fill, 0)}
+	}
+
+	fills := ob.match(t)
+
+	switch {
+	case t.cancelled:
+		// Self-trade prevention cancelled whatever was left of the incoming order.
+		order.Status = types.StatusCancelled
+	case t.satisfied():
+		order.Status = types.StatusFilled
+	case isMarket(order.Type), order.TimeInForce == types.IOC, order.TimeInForce == types.FOK:
+		// Market and immediate-or-cancel orders never rest; whatever is left is cancelled.
+		order.Status = types.StatusCancelled
+	default:
+		// If the order is not fully filled, add it to the book.
+		updateStatus(order)
 		ob.add(order)
 	}
+	if t.quote != nil {
+		// A quote-denominated order's base quantity is whatever it managed to buy or sell.
+		order.Quantity = order.Filled
+	}
 
-	return fills
+	makers := make([]types.Order, len(t.makers))
+	for i, maker := range t.makers {
+		makers[i] = *maker
+	}
+	decremented := make([]types.Order, len(t.makersDecremented))
+	for i, resting := range t.makersDecremented {
+		decremented[i] = *resting
+	}
+	return AddResult{Order: *order, Fills: fills, Makers: makers, Cancelled: t.makersCancelled, Decremented: decremented}
 }
 
-// matchBid attempts to match a buy order (bid) with existing sell orders (asks).
-func (ob *Orderbook) matchBid(order *types.Order) []types.Fill {
-	fills := make([]types.Fill, 0)
+// Order returns a copy of a resting or untriggered stop order.
+func (ob *Orderbook) Order(orderID uuid.UUID) (types.Order, bool) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
 
-	// Iterate through asks from lowest price to highest
-	for i := 0; i < len(ob.askPrices) && order.Filled.LessThan(order.Quantity); {
-		askPrice := ob.askPrices[i]
-		if order.Price.LessThan(askPrice) {
-			break
-		}
+	node, ok := ob.lookup(orderID)
+	if !ok {
+		return types.Order{}, false
+	}
+	return *node.order, true
+}
 
-		ordersAtPrice := ob.getOrdersByPrice(types.Sell, askPrice)
-		for _, matchedOrder := range ordersAtPrice {
-			if order.Filled.Equal(order.Quantity) {
-				break
-			}
+// CancelOrder removes a resting or untriggered stop order from the book. The order must belong to userID.
+// It returns the removed order so the caller can report its final state.
+func (ob *Orderbook) CancelOrder(orderID, userID uuid.UUID) (*types.Order, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
 
-			qtyToFill := decimal.Min(order.Quantity.Sub(order.Filled), matchedOrder.Quantity.Sub(matchedOrder.Filled))
-			order.Filled = order.Filled.Add(qtyToFill)
-			matchedOrder.Filled = matchedOrder.Filled.Add(qtyToFill)
+	node, ok := ob.lookup(orderID)
+	if !ok {
+		return nil, ErrOrderNotFound
+	}
+	if node.order.UserID != userID {
+		return nil, ErrNotOrderOwner
+	}
 
-			fills = append(fills, types.Fill{
-				Qty:           qtyToFill,
-				Price:         matchedOrder.Price,
-				TradeID:       time.Now().UnixNano(),
-				MarketOrderID: matchedOrder.ID,
-				OtherUserID:   matchedOrder.UserID,
-			})
+	ob.discard(node)
+	node.order.Status = types.StatusCancelled
+	return node.order, nil
+}
 
-			if matchedOrder.Filled.Equal(matchedOrder.Quantity) {
-				ob.remove(matchedOrder)
-			}
-		}
+// AmendOrder changes the price and/or quantity of a resting order in one step.
+// Reducing the quantity keeps the order's place in the queue. Changing the price
+// or increasing the quantity re-enters it at the back of the queue for its price,
+// where it may trade straight away like a new order. A post-only order moved to a
+// price that would take liquidity is rejected or repriced as when it was placed.
+func (ob *Orderbook) AmendOrder(data types.AmendOrderData) (AddResult, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
 
-		if len(ob.getOrdersByPrice(types.Sell, askPrice)) == 0 {
-			ob.removePrice(types.Sell, askPrice)
-		} else {
-			i++
+	node, ok := ob.orders[data.OrderID]
+	if !ok {
+		return AddResult{}, ErrOrderNotFound
+	}
+	order := node.order
+	if order.UserID != data.UserID {
+		return AddResult{}, ErrNotOrderOwner
+	}
+
+	price, quantity := order.Price, order.Quantity
+	if data.Price.IsPositive() {
+		price = data.Price
+	}
+	if data.Quantity.IsPositive() {
+		quantity = data.Quantity
+	}
+	if !quantity.GreaterThan(order.Filled) {
+		return AddResult{}, ErrInvalidAmend
+	}
+	if order.PostOnly && !price.Equal(order.Price) {
+		var err error
+		if price, err = ob.postOnlyPrice(order.Side, price, order.PostOnlyReprice); err != nil {
+			return AddResult{}, err
 		}
 	}
-	return fills
+
+	if price.Equal(order.Price) && quantity.LessThanOrEqual(order.Quantity) {
+		// A pure size reduction keeps time priority.
+		node.level.resize(node, func() {
+			order.Quantity = quantity
+			if isIceberg(order) {
+				order.Visible = decimal.Min(order.Visible, order.Remaining())
+			}
+		})
+		updateStatus(order)
+		return AddResult{Order: *order, Fills: make([]types.Fill, 0)}, nil
+	}
+
+	ob.remove(node)
+	order.Price, order.Quantity = price, quantity
+	result := ob.execute(node)
+	result.Triggered = ob.activateStops()
+	return result, nil
 }
 
-// matchAsk attempts to match a sell order (ask) with existing buy orders (bids).
-func (ob *Orderbook) matchAsk(order *types.Order) []types.Fill {
-	fills := make([]types.Fill, 0)
+// ExpireOrder removes a good-till-date order, resting or untriggered, whose expiry has passed.
+// It returns ErrOrderNotFound if the order already left the book.
+func (ob *Orderbook) ExpireOrder(orderID uuid.UUID) (*types.Order, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
 
-	// Iterate through bids from highest price to lowest
-	for i := 0; i < len(ob.bidPrices) && order.Filled.LessThan(order.Quantity); {
-		bidPrice := ob.bidPrices[i]
-		if order.Price.GreaterThan(bidPrice) {
-			break
-		}
+	node, ok := ob.lookup(orderID)
+	if !ok {
+		return nil, ErrOrderNotFound
+	}
 
-		ordersAtPrice := ob.getOrdersByPrice(types.Buy, bidPrice)
-		for _, matchedOrder := range ordersAtPrice {
-			if order.Filled.Equal(order.Quantity) {
-				break
-			}
-			qtyToFill := decimal.Min(order.Quantity.Sub(order.Filled), matchedOrder.Quantity.Sub(matchedOrder.Filled))
-			order.Filled = order.Filled.Add(qtyToFill)
-			matchedOrder.Filled = matchedOrder.Filled.Add(qtyToFill)
-
-			fills = append(fills, types.Fill{
-				Qty:           qtyToFill,
-				Price:         matchedOrder.Price,
-				TradeID:       time.Now().UnixNano(),
-				MarketOrderID: matchedOrder.ID,
-				OtherUserID:   matchedOrder.UserID,
-			})
-
-			if matchedOrder.Filled.Equal(matchedOrder.Quantity) {
-				ob.remove(matchedOrder)
-			}
-		}
+	ob.discard(node)
+	node.order.Status = types.StatusExpired
+	return node.order, nil
+}
 
-		if len(ob.getOrdersByPrice(types.Buy, bidPrice)) == 0 {
-			ob.removePrice(types.Buy, bidPrice)
-		} else {
-			i++
-		}
+// LastTradeID returns the ID of the most recent trade, zero before the first.
+func (ob *Orderbook) LastTradeID() uint64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+	return ob.tradeID
+}
+
+// Depth aggregates the remaining quantity at each price level, best prices first.
+// A limit of zero or less returns every level.
+func (ob *Orderbook) Depth(limit int) types.DepthPayload {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return types.DepthPayload{
+		Market: ob.market,
+		Bids:   levels(ob.bids, limit),
+		Asks:   levels(ob.asks, limit),
 	}
-	return fills
 }
 
 // --- Helper methods for managing the orderbook state ---
 
-func (ob *Orderbook) add(order *types.Order) {
-	if order.Side == types.Buy {
-		ob.bids[order.ID.String()] = order
-		if !ob.hasPrice(types.Buy, order.Price) {
-			ob.bidPrices = append(ob.bidPrices, order.Price)
-			sort.Slice(ob.bidPrices, func(i, j int) bool {
-				return ob.bidPrices[i].GreaterThan(ob.bidPrices[j]) // Sort high to low
-			})
-		}
-	} else {
-		ob.asks[order.ID.String()] = order
-		if !ob.hasPrice(types.Sell, order.Price) {
-			ob.askPrices = append(ob.askPrices, order.Price)
-			sort.Slice(ob.askPrices, func(i, j int) bool {
-				return ob.askPrices[i].LessThan(ob.askPrices[j]) // Sort low to high
-			})
-		}
+func (ob *Orderbook) side(side types.OrderSide) *priceLadder {
+	if side == types.Buy {
+		return ob.bids
 	}
+	return ob.asks
 }
 
-func (ob *Orderbook) remove(order *types.Order) {
-	if order.Side == types.Buy {
-		delete(ob.bids, order.ID.String())
-	} else {
-		delete(ob.asks, order.ID.String())
+// add appends the order to the back of its price level's queue.
+// An iceberg order shows only its first slice.
+func (ob *Orderbook) add(order *types.Order) {
+	if isIceberg(order) {
+		order.Visible = decimal.Min(order.DisplayQuantity, order.Remaining())
 	}
 
-	if len(ob.getOrdersByPrice(order.Side, order.Price)) == 0 {
-		ob.removePrice(order.Side, order.Price)
+	ladder := ob.side(order.Side)
+	level := ladder.get(order.Price)
+	if level == nil {
+		level = newPriceLevel(order.Price)
+		ladder.insert(level)
 	}
+
+	node := &orderNode{order: order}
+	level.push(node)
+	ob.orders[order.ID] = node
 }
 
-func (ob *Orderbook) hasPrice(side types.OrderSide, price decimal.Decimal) bool {
-	prices := ob.bidPrices
-	if side == types.Sell {
-		prices = ob.askPrices
-	}
-	for _, p := range prices {
-		if p.Equal(price) {
-			return true
-		}
+// remove takes the order out of the book, dropping its price level once empty.
+func (ob *Orderbook) remove(node *orderNode) {
+	level := node.level
+	level.unlink(node)
+	delete(ob.orders, node.order.ID)
+
+	if level.empty() {
+		ob.side(node.order.Side).delete(level.price)
 	}
-	return false
 }
 
-func (ob *Orderbook) removePrice(side types.OrderSide, price decimal.Decimal) {
-	if side == types.Buy {
-		for i, p := range ob.bidPrices {
-			if p.Equal(price) {
-				ob.bidPrices = append(ob.bidPrices[:i], ob.bidPrices[i+1:]...)
-				return
-			}
-		}
-	} else {
-		for i, p := range ob.askPrices {
-			if p.Equal(price) {
-				ob.askPrices = append(ob.askPrices[:i], ob.askPrices[i+1:]...)
-				return
-			}
-		}
+// lookup finds a resting order or an untriggered stop order by ID.
+func (ob *Orderbook) lookup(orderID uuid.UUID) (*orderNode, bool) {
+	if node, ok := ob.orders[orderID]; ok {
+		return node, true
 	}
+	node, ok := ob.stops[orderID]
+	return node, ok
 }
 
-func (ob *Orderbook) getOrdersByPrice(side types.OrderSide, price decimal.Decimal) []*types.Order {
-	orders := make([]*types.Order, 0)
-	source := ob.bids
-	if side == types.Sell {
-		source = ob.asks
+// discard removes an order found by lookup from whichever book holds it.
+func (ob *Orderbook) discard(node *orderNode) {
+	if _, ok := ob.stops[node.order.ID]; ok {
+		ob.removeStop(node)
+		return
 	}
-	for _, order := range source {
-		if order.Price.Equal(price) {
-			orders = append(orders, order)
-		}
+	ob.remove(node)
+}
+
+func levels(ladder *priceLadder, limit int) [][2]decimal.Decimal {
+	if limit <= 0 || limit > ladder.length {
+		limit = ladder.length
 	}
-	return orders
+	levels := make([][2]decimal.Decimal, 0, limit)
+	ladder.each(func(level *priceLevel) bool {
+		levels = append(levels, [2]decimal.Decimal{level.price, level.volume})
+		return len(levels) < limit
+	})
+	return levels
 }
@@ -0,0 +1,772 @@
+package matching
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func limitOrder(user uuid.UUID, side types.OrderSide, price, qty string) types.CreateOrderData {
+	return types.CreateOrderData{
+		UserID:   user,
+		Market:   "SOL_USDC",
+		Price:    decimal.RequireFromString(price),
+		Quantity: decimal.RequireFromString(qty),
+		Side:     side,
+	}
+}
+
+// place adds an order that is expected to be accepted and returns the order and its fills.
+func place(tb testing.TB, ob *Orderbook, data types.CreateOrderData) (types.Order, []types.Fill) {
+	tb.Helper()
+	result, err := ob.AddOrder(data)
+	if err != nil {
+		tb.Fatalf("AddOrder: %v", err)
+	}
+	return result.Order, result.Fills
+}
+
+func TestEarliestOrderAtLevelFillsFirst(t *testing.T) {
+	// Go map iteration is randomised, so repeat enough times to catch any reliance on it.
+	for run := 0; run < 50; run++ {
+		ob := NewOrderbook("SOL_USDC")
+
+		makers := make([]uuid.UUID, 5)
+		for i := range makers {
+			makers[i] = uuid.New()
+			place(t, ob, limitOrder(makers[i], types.Sell, "100", "1"))
+		}
+
+		_, fills := place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "3.5"))
+		if len(fills) != 4 {
+			t.Fatalf("run %d: expected 4 fills, got %d", run, len(fills))
+		}
+		for i, fill := range fills {
+			if fill.MakerUserID != makers[i] {
+				t.Fatalf("run %d: fill %d matched maker %d out of arrival order", run, i, indexOf(makers, fill.MakerUserID))
+			}
+		}
+		if !fills[3].Qty.Equal(decimal.RequireFromString("0.5")) {
+			t.Fatalf("run %d: expected last fill of 0.5, got %s", run, fills[3].Qty)
+		}
+
+		// The partially filled maker keeps its place at the head of the queue.
+		_, fills = place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "1"))
+		if fills[0].MakerUserID != makers[3] || fills[1].MakerUserID != makers[4] {
+			t.Fatalf("run %d: partially filled order lost its queue position", run)
+		}
+	}
+}
+
+func TestBetterPriceBeatsEarlierArrival(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	early, better := uuid.New(), uuid.New()
+	place(t, ob, limitOrder(early, types.Buy, "99", "1"))
+	place(t, ob, limitOrder(better, types.Buy, "100", "1"))
+
+	_, fills := place(t, ob, limitOrder(uuid.New(), types.Sell, "99", "1"))
+	if len(fills) != 1 || fills[0].MakerUserID != better {
+		t.Fatalf("expected the higher bid to fill first, got %+v", fills)
+	}
+}
+
+func TestFillsRecordMakerAndTaker(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	buyer, seller := uuid.New(), uuid.New()
+	bid, _ := place(t, ob, limitOrder(buyer, types.Buy, "100", "1"))
+
+	ask, fills := place(t, ob, limitOrder(seller, types.Sell, "100", "1"))
+	if len(fills) != 1 {
+		t.Fatalf("expected 1 fill, got %d", len(fills))
+	}
+	fill := fills[0]
+	if fill.MakerOrderID != bid.ID || fill.MakerUserID != buyer || fill.TakerOrderID != ask.ID || fill.TakerUserID != seller {
+		t.Fatalf("fill attributed to the wrong orders: %+v", fill)
+	}
+	if fill.TakerSide != types.Sell || !fill.IsBuyerMaker() || fill.Buyer() != buyer || fill.Seller() != seller {
+		t.Fatalf("expected a sell aggressor hitting a resting buyer, got %+v", fill)
+	}
+}
+
+func TestTradeIDsCountUpWithoutGaps(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	for i := 0; i < 3; i++ {
+		place(t, ob, limitOrder(uuid.New(), types.Sell, "100", "1"))
+	}
+	_, fills := place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "2"))
+	_, more := place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "1"))
+
+	for i, fill := range append(fills, more...) {
+		if fill.TradeID != uint64(i+1) {
+			t.Fatalf("fill %d: expected trade ID %d, got %d", i, i+1, fill.TradeID)
+		}
+	}
+	if ob.LastTradeID() != 3 {
+		t.Fatalf("expected last trade ID 3, got %d", ob.LastTradeID())
+	}
+}
+
+func TestCancelKeepsQueueOrderOfRemainingOrders(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	first, second, third := uuid.New(), uuid.New(), uuid.New()
+	place(t, ob, limitOrder(first, types.Sell, "100", "1"))
+	middle, _ := place(t, ob, limitOrder(second, types.Sell, "100", "1"))
+	place(t, ob, limitOrder(third, types.Sell, "100", "1"))
+
+	if _, err := ob.CancelOrder(middle.ID, second); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+
+	_, fills := place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "2"))
+	if len(fills) != 2 || fills[0].MakerUserID != first || fills[1].MakerUserID != third {
+		t.Fatalf("unexpected fill order after cancel: %+v", fills)
+	}
+}
+
+func TestArrivalSequenceIsAssignedInOrder(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	a, _ := place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "1"))
+	b, _ := place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "1"))
+	if a.Seq == 0 || b.Seq <= a.Seq {
+		t.Fatalf("expected increasing sequence numbers, got %d then %d", a.Seq, b.Seq)
+	}
+}
+
+func TestDepthAggregatesRemainingQuantityPerLevel(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "101", "2"))
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "101", "3"))
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "102", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Buy, "99", "4"))
+	place(t, ob, limitOrder(uuid.New(), types.Buy, "98", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Buy, "101", "1.5"))
+
+	depth := ob.Depth(0)
+	wantAsks := [][2]string{{"101", "3.5"}, {"102", "1"}}
+	wantBids := [][2]string{{"99", "4"}, {"98", "1"}}
+	assertLevels(t, "asks", depth.Asks, wantAsks)
+	assertLevels(t, "bids", depth.Bids, wantBids)
+
+	if limited := ob.Depth(1); len(limited.Asks) != 1 || len(limited.Bids) != 1 {
+		t.Fatalf("expected one level per side with limit 1, got %d asks and %d bids", len(limited.Asks), len(limited.Bids))
+	}
+}
+
+func TestLadderStaysOrderedUnderRandomUpdates(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ladder := newPriceLadder(decimal.Decimal.LessThan)
+	present := make(map[int64]bool)
+
+	for i := 0; i < 5000; i++ {
+		p := rng.Int63n(500)
+		price := decimal.New(p, -2)
+		if present[p] {
+			ladder.delete(price)
+			delete(present, p)
+		} else {
+			ladder.insert(newPriceLevel(price))
+			present[p] = true
+		}
+	}
+
+	want := make([]int64, 0, len(present))
+	for p := range present {
+		want = append(want, p)
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+
+	got := make([]int64, 0, ladder.length)
+	ladder.each(func(level *priceLevel) bool {
+		got = append(got, level.price.Shift(2).IntPart())
+		return true
+	})
+	if len(got) != len(want) || ladder.length != len(want) {
+		t.Fatalf("expected %d levels, got %d (length %d)", len(want), len(got), ladder.length)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("level %d: expected %d, got %d", i, want[i], got[i])
+		}
+		if ladder.get(decimal.New(want[i], -2)) == nil {
+			t.Fatalf("get(%d) did not find an existing level", want[i])
+		}
+	}
+}
+
+func TestMarketOrderSweepsLevelsAndNeverRests(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "100", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "101", "1"))
+
+	order, fills := place(t, ob, types.CreateOrderData{UserID: uuid.New(), Type: types.Market, Side: types.Buy, Quantity: decimal.NewFromInt(3)})
+	if len(fills) != 2 || !order.Filled.Equal(decimal.NewFromInt(2)) {
+		t.Fatalf("expected to sweep both levels, got %d fills and %s filled", len(fills), order.Filled)
+	}
+	if order.Status != types.StatusCancelled {
+		t.Fatalf("expected unfilled remainder to be cancelled, got %s", order.Status)
+	}
+	if depth := ob.Depth(0); len(depth.Bids) != 0 || len(depth.Asks) != 0 {
+		t.Fatalf("market order must not rest on the book, depth is %+v", depth)
+	}
+}
+
+func TestMarketOrderSpendsQuoteQuantity(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC", WithLotSize(decimal.RequireFromString("0.01")))
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "100", "2"))
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "200", "5"))
+
+	// 200 buys 2 at 100, leaving 300 which buys 1.5 at 200.
+	order, fills := place(t, ob, types.CreateOrderData{UserID: uuid.New(), Type: types.Market, Side: types.Buy, QuoteQuantity: decimal.NewFromInt(500)})
+	if len(fills) != 2 || !fills[1].Qty.Equal(decimal.RequireFromString("1.5")) {
+		t.Fatalf("unexpected fills %+v", fills)
+	}
+	if !order.Quantity.Equal(decimal.RequireFromString("3.5")) || order.Status != types.StatusFilled {
+		t.Fatalf("expected 3.5 filled, got quantity %s status %s", order.Quantity, order.Status)
+	}
+}
+
+func TestMarketOrderStopsAtSlippageBound(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Buy, "99.5", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Buy, "98", "1"))
+
+	// 1% below the best bid of 100 is 99, so the 98 level must not be touched.
+	order, fills := place(t, ob, types.CreateOrderData{UserID: uuid.New(), Type: types.Market, Side: types.Sell, Quantity: decimal.NewFromInt(3), MaxSlippage: decimal.RequireFromString("0.01")})
+	if len(fills) != 2 || !order.Filled.Equal(decimal.NewFromInt(2)) {
+		t.Fatalf("expected two fills within the bound, got %+v", fills)
+	}
+	if depth := ob.Depth(0); len(depth.Bids) != 1 || !depth.Bids[0][0].Equal(decimal.NewFromInt(98)) {
+		t.Fatalf("expected the 98 bid to remain, got %+v", depth.Bids)
+	}
+}
+
+func TestImmediateOrCancelDropsRemainder(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "100", "1"))
+
+	data := limitOrder(uuid.New(), types.Buy, "100", "3")
+	data.TimeInForce = types.IOC
+	order, fills := place(t, ob, data)
+	if len(fills) != 1 || order.Status != types.StatusCancelled {
+		t.Fatalf("expected one fill and a cancelled remainder, got %d fills, status %s", len(fills), order.Status)
+	}
+	if depth := ob.Depth(0); len(depth.Bids) != 0 {
+		t.Fatalf("IOC remainder must not rest, bids are %+v", depth.Bids)
+	}
+}
+
+func TestFillOrKillIsAllOrNothing(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "100", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "101", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "102", "5"))
+
+	// Only 2 are available at or below 101, so nothing may trade.
+	kill := limitOrder(uuid.New(), types.Buy, "101", "3")
+	kill.TimeInForce = types.FOK
+	order, fills := place(t, ob, kill)
+	if len(fills) != 0 || order.Status != types.StatusCancelled {
+		t.Fatalf("expected the FOK order to be killed untouched, got %d fills, status %s", len(fills), order.Status)
+	}
+	if depth := ob.Depth(0); len(depth.Asks) != 3 {
+		t.Fatalf("killed FOK order changed the book: %+v", depth.Asks)
+	}
+
+	fill := limitOrder(uuid.New(), types.Buy, "102", "3")
+	fill.TimeInForce = types.FOK
+	order, fills = place(t, ob, fill)
+	if len(fills) != 3 || order.Status != types.StatusFilled {
+		t.Fatalf("expected the FOK order to fill completely, got %d fills, status %s", len(fills), order.Status)
+	}
+}
+
+func TestFillOrKillNeverPartlyFillsUnderSelfTradePrevention(t *testing.T) {
+	user, other := uuid.New(), uuid.New()
+	for _, mode := range []types.SelfTradePrevention{types.CancelNewest, types.CancelBoth, types.DecrementAndCancel} {
+		ob := NewOrderbook("SOL_USDC")
+		place(t, ob, limitOrder(other, types.Sell, "100", "1"))
+		place(t, ob, limitOrder(user, types.Sell, "100", "1"))
+		place(t, ob, limitOrder(other, types.Sell, "100", "5"))
+
+		// Only 1 trades before the user's own order stops or shrinks the taker.
+		kill := limitOrder(user, types.Buy, "100", "3")
+		kill.TimeInForce = types.FOK
+		kill.SelfTradePrevention = mode
+		result, _ := ob.AddOrder(kill)
+		if len(result.Fills) != 0 || len(result.Cancelled) != 0 || result.Order.Status != types.StatusCancelled {
+			t.Fatalf("%s: expected the FOK order to be killed untouched, got %+v", mode, result)
+		}
+		if depth := ob.Depth(0); !depth.Asks[0][1].Equal(decimal.NewFromInt(7)) {
+			t.Fatalf("%s: killed FOK order changed the book: %+v", mode, depth.Asks)
+		}
+
+		// Cancelling the user's own orders instead leaves 6 to trade with.
+		kill.SelfTradePrevention = types.CancelOldest
+		result, _ = ob.AddOrder(kill)
+		if len(result.Fills) != 2 || result.Order.Status != types.StatusFilled {
+			t.Fatalf("%s: expected the FOK order to fill completely, got %+v", mode, result)
+		}
+	}
+}
+
+func TestExpireOrderRemovesRestingOrder(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	data := limitOrder(uuid.New(), types.Buy, "100", "1")
+	data.TimeInForce = types.GTD
+	data.ExpireAt = 1
+	resting, _ := place(t, ob, data)
+
+	expired, err := ob.ExpireOrder(resting.ID)
+	if err != nil || expired.Status != types.StatusExpired {
+		t.Fatalf("expected the order to expire, got %v (%v)", expired, err)
+	}
+	if _, err := ob.ExpireOrder(resting.ID); err != ErrOrderNotFound {
+		t.Fatalf("expected ErrOrderNotFound expiring twice, got %v", err)
+	}
+}
+
+func TestPostOnlyRejectsOrRepricesCrossingOrders(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC", WithTickSize(decimal.RequireFromString("0.01")))
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "100", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Buy, "99", "1"))
+
+	crossing := limitOrder(uuid.New(), types.Buy, "100", "1")
+	crossing.PostOnly = true
+	if _, err := ob.AddOrder(crossing); err != ErrPostOnlyWouldCross {
+		t.Fatalf("expected ErrPostOnlyWouldCross, got %v", err)
+	}
+
+	crossing.PostOnlyReprice = true
+	result, err := ob.AddOrder(crossing)
+	if err != nil || len(result.Fills) != 0 {
+		t.Fatalf("expected the repriced order to rest, got %d fills (%v)", len(result.Fills), err)
+	}
+	if order := result.Order; !order.Price.Equal(decimal.RequireFromString("99.99")) {
+		t.Fatalf("expected a price one tick below the best ask, got %s", order.Price)
+	}
+
+	passive := limitOrder(uuid.New(), types.Sell, "100.5", "1")
+	passive.PostOnly = true
+	if _, err := ob.AddOrder(passive); err != nil {
+		t.Fatalf("non-crossing post-only order was rejected: %v", err)
+	}
+}
+
+func TestSelfTradePreventionModes(t *testing.T) {
+	user, other := uuid.New(), uuid.New()
+
+	setup := func() (*Orderbook, types.Order) {
+		ob := NewOrderbook("SOL_USDC")
+		own, _ := place(t, ob, limitOrder(user, types.Sell, "100", "2"))
+		place(t, ob, limitOrder(other, types.Sell, "100", "2"))
+		return ob, own
+	}
+	incoming := func(mode types.SelfTradePrevention, qty string) types.CreateOrderData {
+		data := limitOrder(user, types.Buy, "100", qty)
+		data.SelfTradePrevention = mode
+		return data
+	}
+
+	t.Run("cancel newest", func(t *testing.T) {
+		ob, _ := setup()
+		result, _ := ob.AddOrder(incoming(types.CancelNewest, "3"))
+		if len(result.Fills) != 0 || result.Order.Status != types.StatusCancelled || len(result.Cancelled) != 0 {
+			t.Fatalf("expected only the incoming order to be cancelled, got %+v", result)
+		}
+	})
+
+	t.Run("cancel oldest", func(t *testing.T) {
+		ob, own := setup()
+		result, _ := ob.AddOrder(incoming(types.CancelOldest, "2"))
+		if len(result.Cancelled) != 1 || result.Cancelled[0].ID != own.ID {
+			t.Fatalf("expected the resting order to be cancelled, got %+v", result.Cancelled)
+		}
+		if len(result.Fills) != 1 || result.Fills[0].MakerUserID != other || result.Order.Status != types.StatusFilled {
+			t.Fatalf("expected to fill against the other user, got %+v", result)
+		}
+	})
+
+	t.Run("cancel both", func(t *testing.T) {
+		ob, own := setup()
+		result, _ := ob.AddOrder(incoming(types.CancelBoth, "2"))
+		if len(result.Fills) != 0 || result.Order.Status != types.StatusCancelled {
+			t.Fatalf("expected the incoming order to be cancelled untraded, got %+v", result)
+		}
+		if len(result.Cancelled) != 1 || result.Cancelled[0].ID != own.ID {
+			t.Fatalf("expected the resting order to be cancelled, got %+v", result.Cancelled)
+		}
+	})
+
+	t.Run("decrement and cancel", func(t *testing.T) {
+		ob, own := setup()
+		// The 3 overlaps the own order by 2, which cancels it and leaves 1 to trade with the other user.
+		result, _ := ob.AddOrder(incoming(types.DecrementAndCancel, "3"))
+		if len(result.Cancelled) != 1 || result.Cancelled[0].ID != own.ID {
+			t.Fatalf("expected the resting order to be cancelled, got %+v", result.Cancelled)
+		}
+		if len(result.Fills) != 1 || !result.Fills[0].Qty.Equal(decimal.NewFromInt(1)) {
+			t.Fatalf("expected a single fill of 1, got %+v", result.Fills)
+		}
+		if !result.Order.Quantity.Equal(decimal.NewFromInt(1)) || result.Order.Status != types.StatusFilled {
+			t.Fatalf("expected the incoming order to shrink to 1 and fill, got %+v", result.Order)
+		}
+	})
+
+	t.Run("decrement and cancel reports the shrunk resting order", func(t *testing.T) {
+		ob, own := setup()
+		result, _ := ob.AddOrder(incoming(types.DecrementAndCancel, "1"))
+		if len(result.Fills) != 0 || len(result.Cancelled) != 0 || result.Order.Status != types.StatusCancelled {
+			t.Fatalf("expected the incoming order to be cancelled untraded, got %+v", result)
+		}
+		if len(result.Decremented) != 1 || result.Decremented[0].ID != own.ID || !result.Decremented[0].Quantity.Equal(decimal.NewFromInt(1)) {
+			t.Fatalf("expected the resting order to be reported shrunk to 1, got %+v", result.Decremented)
+		}
+	})
+}
+
+func TestStopOrdersTriggerOnLastTradePrice(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "100", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "101", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "102", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "103", "1"))
+
+	// A stop-market buy at 101, and a stop-limit buy at 102 that the first stop's fill will trigger.
+	stopMarket, _ := place(t, ob, types.CreateOrderData{UserID: uuid.New(), Type: types.StopMarket, Side: types.Buy, StopPrice: decimal.NewFromInt(101), Quantity: decimal.NewFromInt(1)})
+	stopLimit := limitOrder(uuid.New(), types.Buy, "103", "1")
+	stopLimit.Type, stopLimit.StopPrice = types.StopLimit, decimal.NewFromInt(102)
+	pendingLimit, _ := place(t, ob, stopLimit)
+	if stopMarket.Status != types.StatusUntriggered || pendingLimit.Status != types.StatusUntriggered {
+		t.Fatalf("expected stops to wait untriggered, got %s and %s", stopMarket.Status, pendingLimit.Status)
+	}
+
+	// Trading at 100 does not reach either stop.
+	result, _ := ob.AddOrder(limitOrder(uuid.New(), types.Buy, "100", "1"))
+	if len(result.Triggered) != 0 {
+		t.Fatalf("nothing should trigger at 100, got %d", len(result.Triggered))
+	}
+
+	// Trading at 101 triggers the stop-market, whose fill at 102 triggers the stop-limit.
+	result, _ = ob.AddOrder(limitOrder(uuid.New(), types.Buy, "101", "1"))
+	if len(result.Triggered) != 2 {
+		t.Fatalf("expected a cascade of 2 triggered stops, got %d", len(result.Triggered))
+	}
+	first, second := result.Triggered[0], result.Triggered[1]
+	if first.Order.ID != stopMarket.ID || !first.Fills[0].Price.Equal(decimal.NewFromInt(102)) {
+		t.Fatalf("expected the stop-market to fill at 102 first, got %+v", first)
+	}
+	if second.Order.ID != pendingLimit.ID || !second.Fills[0].Price.Equal(decimal.NewFromInt(103)) || second.Order.Status != types.StatusFilled {
+		t.Fatalf("expected the stop-limit to fill at 103 second, got %+v", second)
+	}
+}
+
+func TestStopOrderRejectedWhenAlreadyReachedAndCancellable(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "100", "1"))
+	place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "1"))
+
+	stop := types.CreateOrderData{UserID: uuid.New(), Type: types.StopMarket, Side: types.Sell, StopPrice: decimal.NewFromInt(100), Quantity: decimal.NewFromInt(1)}
+	if _, err := ob.AddOrder(stop); err != ErrStopWouldTrigger {
+		t.Fatalf("expected ErrStopWouldTrigger, got %v", err)
+	}
+
+	stop.StopPrice = decimal.NewFromInt(95)
+	pending, _ := place(t, ob, stop)
+	cancelled, err := ob.CancelOrder(pending.ID, stop.UserID)
+	if err != nil || cancelled.Status != types.StatusCancelled {
+		t.Fatalf("expected to cancel the untriggered stop, got %v (%v)", cancelled, err)
+	}
+}
+
+func TestIcebergShowsSliceAndLosesPriorityOnRefill(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	iceberg := limitOrder(uuid.New(), types.Sell, "100", "10")
+	iceberg.DisplayQuantity = decimal.NewFromInt(2)
+	icebergOrder, _ := place(t, ob, iceberg)
+	behind := uuid.New()
+	place(t, ob, limitOrder(behind, types.Sell, "100", "1"))
+
+	assertLevels(t, "asks", ob.Depth(0).Asks, [][2]string{{"100", "3"}})
+
+	// The visible slice fills, the refill goes behind the other order, which fills next.
+	_, fills := place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "3"))
+	if len(fills) != 2 || fills[0].MakerOrderID != icebergOrder.ID || fills[1].MakerUserID != behind {
+		t.Fatalf("expected the iceberg slice then the order behind it, got %+v", fills)
+	}
+	assertLevels(t, "asks", ob.Depth(0).Asks, [][2]string{{"100", "2"}})
+
+	// A larger order keeps trading through successive refills.
+	_, fills = place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "5"))
+	total := decimal.Zero
+	for _, fill := range fills {
+		total = total.Add(fill.Qty)
+	}
+	if !total.Equal(decimal.NewFromInt(5)) {
+		t.Fatalf("expected 5 to trade against the iceberg, got %s", total)
+	}
+	// 3 remain, of which only 1 is left in the current slice.
+	assertLevels(t, "asks", ob.Depth(0).Asks, [][2]string{{"100", "1"}})
+}
+
+func TestAmendKeepsPriorityOnlyWhenReducing(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	first, second := uuid.New(), uuid.New()
+	firstOrder, _ := place(t, ob, limitOrder(first, types.Sell, "100", "3"))
+	secondOrder, _ := place(t, ob, limitOrder(second, types.Sell, "100", "2"))
+
+	if _, err := ob.AmendOrder(types.AmendOrderData{UserID: second, OrderID: firstOrder.ID, Quantity: decimal.NewFromInt(1)}); err != ErrNotOrderOwner {
+		t.Fatalf("expected ErrNotOrderOwner, got %v", err)
+	}
+
+	// Reducing the size keeps the first order at the head of the queue.
+	result, err := ob.AmendOrder(types.AmendOrderData{UserID: first, OrderID: firstOrder.ID, Quantity: decimal.NewFromInt(1)})
+	if err != nil || result.Order.Seq != firstOrder.Seq {
+		t.Fatalf("expected reduction to keep seq %d, got %+v (%v)", firstOrder.Seq, result.Order, err)
+	}
+	assertLevels(t, "asks", ob.Depth(0).Asks, [][2]string{{"100", "3"}})
+
+	// Increasing it again sends it behind the second order.
+	if _, err := ob.AmendOrder(types.AmendOrderData{UserID: first, OrderID: firstOrder.ID, Quantity: decimal.NewFromInt(2)}); err != nil {
+		t.Fatalf("AmendOrder: %v", err)
+	}
+	_, fills := place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "1"))
+	if fills[0].MakerOrderID != secondOrder.ID {
+		t.Fatalf("expected the second order to fill first after the increase, got %+v", fills)
+	}
+
+	// A new price can cross the spread and trade straight away.
+	place(t, ob, limitOrder(uuid.New(), types.Buy, "99", "1"))
+	result, err = ob.AmendOrder(types.AmendOrderData{UserID: first, OrderID: firstOrder.ID, Price: decimal.NewFromInt(99)})
+	if err != nil || len(result.Fills) != 1 || result.Order.Status != types.StatusPartiallyFilled {
+		t.Fatalf("expected the repriced order to trade once, got %+v (%v)", result, err)
+	}
+	assertLevels(t, "asks", ob.Depth(0).Asks, [][2]string{{"99", "1"}, {"100", "1"}})
+
+	if _, err := ob.AmendOrder(types.AmendOrderData{UserID: first, OrderID: firstOrder.ID, Quantity: decimal.NewFromInt(1)}); err != ErrInvalidAmend {
+		t.Fatalf("expected ErrInvalidAmend when amending to the filled quantity, got %v", err)
+	}
+}
+
+func TestAmendKeepsPostOnlyOrdersPassive(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC", WithTickSize(decimal.RequireFromString("0.01")))
+	user := uuid.New()
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "100", "1"))
+	data := limitOrder(user, types.Buy, "99", "1")
+	data.PostOnly = true
+	bid, _ := place(t, ob, data)
+
+	// Moving the bid through the ask would take liquidity, so it is refused and the bid stays put.
+	if _, err := ob.AmendOrder(types.AmendOrderData{UserID: user, OrderID: bid.ID, Price: decimal.NewFromInt(101)}); err != ErrPostOnlyWouldCross {
+		t.Fatalf("expected ErrPostOnlyWouldCross, got %v", err)
+	}
+	assertLevels(t, "bids", ob.Depth(0).Bids, [][2]string{{"99", "1"}})
+
+	// With repricing it moves to one tick below the ask instead of trading.
+	data.PostOnlyReprice = true
+	repriced, _ := place(t, ob, data)
+	result, err := ob.AmendOrder(types.AmendOrderData{UserID: user, OrderID: repriced.ID, Price: decimal.NewFromInt(101)})
+	if err != nil || len(result.Fills) != 0 || !result.Order.Price.Equal(decimal.RequireFromString("99.99")) {
+		t.Fatalf("expected the amend to rest at 99.99 untraded, got %+v (%v)", result, err)
+	}
+	assertLevels(t, "asks", ob.Depth(0).Asks, [][2]string{{"100", "1"}})
+}
+
+func TestInjectedClockAndIDsMakeFillsRepeatable(t *testing.T) {
+	run := func() []types.Fill {
+		next := 0
+		ob := NewOrderbook("SOL_USDC",
+			WithClock(func() time.Time { return time.UnixMilli(1700000000000) }),
+			WithIDGenerator(func() uuid.UUID {
+				next++
+				return uuid.NewSHA1(uuid.Nil, []byte{byte(next)})
+			}),
+		)
+		maker, taker := uuid.MustParse("00000000-0000-0000-0000-000000000001"), uuid.MustParse("00000000-0000-0000-0000-000000000002")
+		place(t, ob, limitOrder(maker, types.Sell, "100", "1"))
+		place(t, ob, limitOrder(maker, types.Sell, "101", "1"))
+		_, fills := place(t, ob, limitOrder(taker, types.Buy, "101", "2"))
+		return fills
+	}
+
+	first, second := run(), run()
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("expected identical fills from identical input\nfirst:  %+v\nsecond: %+v", first, second)
+	}
+	if first[0].Timestamp != 1700000000000 {
+		t.Fatalf("expected fills stamped by the injected clock, got %d", first[0].Timestamp)
+	}
+}
+
+func TestSnapshotRestoresQueuesAndCounters(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	first, second := uuid.New(), uuid.New()
+	place(t, ob, limitOrder(first, types.Sell, "100", "1"))
+	iceberg := limitOrder(second, types.Sell, "100", "10")
+	iceberg.DisplayQuantity = decimal.NewFromInt(2)
+	place(t, ob, iceberg)
+	passive := limitOrder(uuid.New(), types.Buy, "99", "4")
+	passive.PostOnly = true
+	place(t, ob, passive)
+	stop := limitOrder(uuid.New(), types.Buy, "105", "1")
+	stop.Type, stop.StopPrice = types.StopLimit, decimal.NewFromInt(104)
+	place(t, ob, stop)
+	// Take part of the first order so the restored book has a trade and a last price.
+	place(t, ob, limitOrder(uuid.New(), types.Buy, "100", "0.5"))
+
+	var buf bytes.Buffer
+	if err := ob.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.LastTradeID() != ob.LastTradeID() {
+		t.Fatalf("expected last trade ID %d, got %d", ob.LastTradeID(), restored.LastTradeID())
+	}
+	want, got := ob.Orders(), restored.Orders()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d orders, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || !got[i].Filled.Equal(want[i].Filled) || !got[i].Visible.Equal(want[i].Visible) || got[i].Seq != want[i].Seq || got[i].PostOnly != want[i].PostOnly {
+			t.Fatalf("order %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+
+	// Both books match the next order the same way, queue position included.
+	next := limitOrder(uuid.New(), types.Buy, "100", "3")
+	_, wantFills := place(t, ob, next)
+	_, gotFills := place(t, restored, next)
+	if len(gotFills) != len(wantFills) {
+		t.Fatalf("expected %d fills after restore, got %d", len(wantFills), len(gotFills))
+	}
+	for i := range wantFills {
+		if gotFills[i].MakerOrderID != wantFills[i].MakerOrderID || !gotFills[i].Qty.Equal(wantFills[i].Qty) || gotFills[i].TradeID != wantFills[i].TradeID {
+			t.Fatalf("fill %d: expected %+v, got %+v", i, wantFills[i], gotFills[i])
+		}
+	}
+	assertLevels(t, "bids", restored.Depth(0).Bids, [][2]string{{"99", "4"}})
+}
+
+func TestSnapshotRejectsDamage(t *testing.T) {
+	ob := NewOrderbook("SOL_USDC")
+	place(t, ob, limitOrder(uuid.New(), types.Sell, "100", "1"))
+
+	var buf bytes.Buffer
+	if err := ob.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	data[len(data)/2] ^= 0xff
+	if _, err := ReadSnapshot(bytes.NewReader(data)); err == nil {
+		t.Fatal("expected a damaged snapshot to be rejected")
+	}
+}
+
+func assertLevels(t *testing.T, name string, got [][2]decimal.Decimal, want [][2]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: expected %d levels, got %d", name, len(want), len(got))
+	}
+	for i := range want {
+		if !got[i][0].Equal(decimal.RequireFromString(want[i][0])) || !got[i][1].Equal(decimal.RequireFromString(want[i][1])) {
+			t.Fatalf("%s level %d: expected %v, got [%s %s]", name, i, want[i], got[i][0], got[i][1])
+		}
+	}
+}
+
+func indexOf(ids []uuid.UUID, id uuid.UUID) int {
+	for i, candidate := range ids {
+		if candidate == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// restingBookSize is the number of orders kept on the book in the benchmarks below.
+const restingBookSize = 100_000
+
+// deepBook rests restingBookSize orders on each side across a few thousand price levels,
+// leaving a gap between the best bid (999.99) and the best ask (1000.01).
+func deepBook(b *testing.B, rng *rand.Rand) *Orderbook {
+	b.Helper()
+	ob := NewOrderbook("SOL_USDC")
+	for i := 0; i < restingBookSize; i++ {
+		tick := rng.Int63n(5000)
+		place(b, ob, types.CreateOrderData{UserID: uuid.New(), Side: types.Sell, Price: decimal.New(100001+tick, -2), Quantity: decimal.NewFromInt(1)})
+		place(b, ob, types.CreateOrderData{UserID: uuid.New(), Side: types.Buy, Price: decimal.New(99999-tick, -2), Quantity: decimal.NewFromInt(1)})
+	}
+	return ob
+}
+
+func BenchmarkAddRestingOrderDeepBook(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	ob := deepBook(b, rng)
+	user := uuid.New()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		order, _ := place(b, ob, types.CreateOrderData{UserID: user, Side: types.Buy, Price: decimal.New(99999-rng.Int63n(5000), -2), Quantity: decimal.NewFromInt(1)})
+		// Cancel it again so the book stays at a constant depth.
+		ob.CancelOrder(order.ID, user)
+	}
+}
+
+func BenchmarkMatchOrderDeepBook(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	ob := deepBook(b, rng)
+	taker, maker := uuid.New(), uuid.New()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Sweep the best ask, then replenish the book so its size is unchanged.
+		place(b, ob, types.CreateOrderData{UserID: taker, Side: types.Buy, Price: decimal.New(200000, -2), Quantity: decimal.NewFromInt(1)})
+		place(b, ob, types.CreateOrderData{UserID: maker, Side: types.Sell, Price: decimal.New(100001+rng.Int63n(5000), -2), Quantity: decimal.NewFromInt(1)})
+	}
+}
+
+func BenchmarkCancelOrderDeepBook(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	ob := deepBook(b, rng)
+	user := uuid.New()
+
+	ids := make([]uuid.UUID, 0, restingBookSize)
+	for i := 0; i < restingBookSize; i++ {
+		order, _ := place(b, ob, types.CreateOrderData{UserID: user, Side: types.Sell, Price: decimal.New(100001+rng.Int63n(5000), -2), Quantity: decimal.NewFromInt(1)})
+		ids = append(ids, order.ID)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Cancel a random resting order and put a new one in its place.
+		j := rng.Intn(len(ids))
+		order, _ := ob.CancelOrder(ids[j], user)
+		replacement, _ := place(b, ob, types.CreateOrderData{UserID: user, Side: types.Sell, Price: order.Price, Quantity: decimal.NewFromInt(1)})
+		ids[j] = replacement.ID
+	}
+}
+
+func BenchmarkDepthDeepBook(b *testing.B) {
+	ob := deepBook(b, rand.New(rand.NewSource(1)))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ob.Depth(50)
+	}
+}
@@ -0,0 +1,93 @@
+package matching
+
+import (
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/shopspring/decimal"
+)
+
+// orderNode links a resting order into the queue of its price level.
+type orderNode struct {
+	order      *types.Order
+	level      *priceLevel
+	prev, next *orderNode
+
+	// Market parameters of an untriggered stop order, applied once it triggers.
+	maxSlippage   decimal.Decimal
+	quoteQuantity decimal.Decimal
+	funds         decimal.Decimal
+}
+
+// priceLevel holds the resting orders at one price as a FIFO linked list,
+// so orders can be appended, matched from the head and cancelled in O(1).
+type priceLevel struct {
+	price      decimal.Decimal
+	head, tail *orderNode      // head is the earliest arrival
+	size       int             // Number of orders in the queue
+	volume     decimal.Decimal // Visible remaining quantity across the queue
+	hidden     decimal.Decimal // Remaining quantity held back by iceberg orders
+}
+
+func newPriceLevel(price decimal.Decimal) *priceLevel {
+	return &priceLevel{price: price, volume: decimal.Zero, hidden: decimal.Zero}
+}
+
+// isIceberg reports whether an order only shows part of its quantity on the book.
+func isIceberg(order *types.Order) bool {
+	return order.DisplayQuantity.IsPositive()
+}
+
+// visibleQty returns the part of a resting order that is shown and can trade right now.
+func visibleQty(order *types.Order) decimal.Decimal {
+	if isIceberg(order) {
+		return order.Visible
+	}
+	return order.Remaining()
+}
+
+// push appends a node to the back of the queue.
+func (l *priceLevel) push(node *orderNode) {
+	node.level = l
+	node.prev, node.next = l.tail, nil
+	if l.tail != nil {
+		l.tail.next = node
+	} else {
+		l.head = node
+	}
+	l.tail = node
+	l.size++
+	l.volume = l.volume.Add(visibleQty(node.order))
+	l.hidden = l.hidden.Add(node.order.Remaining().Sub(visibleQty(node.order)))
+}
+
+// unlink removes a node from anywhere in the queue.
+func (l *priceLevel) unlink(node *orderNode) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		l.head = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		l.tail = node.prev
+	}
+	node.prev, node.next, node.level = nil, nil, nil
+	l.size--
+	l.volume = l.volume.Sub(visibleQty(node.order))
+	l.hidden = l.hidden.Sub(node.order.Remaining().Sub(visibleQty(node.order)))
+}
+
+func (l *priceLevel) empty() bool {
+	return l.head == nil
+}
+
+// resize applies a change to a queued order's quantities in place,
+// keeping the level's totals in step without moving the order.
+func (l *priceLevel) resize(node *orderNode, change func()) {
+	l.volume = l.volume.Sub(visibleQty(node.order))
+	l.hidden = l.hidden.Sub(node.order.Remaining().Sub(visibleQty(node.order)))
+	change()
+	l.volume = l.volume.Add(visibleQty(node.order))
+	l.hidden = l.hidden.Add(node.order.Remaining().Sub(visibleQty(node.order)))
+}
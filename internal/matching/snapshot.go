@@ -0,0 +1,178 @@
+package matching
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Utsav7428/ChronoXchange/internal/snapshot"
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/google/uuid"
+)
+
+const (
+	snapshotMagic   = "CXOB"
+	snapshotVersion = 1
+)
+
+// WriteSnapshot writes the book's state in a versioned binary format: its
+// arrival and trade counters, the last trade price, and every resting and
+// untriggered stop order in queue order, so that a restored book matches
+// exactly as this one would. Tick and lot size come from the market
+// definition and are passed to ReadSnapshot as options instead.
+func (ob *Orderbook) WriteSnapshot(w io.Writer) error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	sw := snapshot.NewWriter(w, snapshotMagic, snapshotVersion)
+	sw.String(ob.market)
+	sw.Uint64(ob.seq)
+	sw.Uint64(ob.tradeID)
+	sw.Decimal(ob.lastPrice)
+	for _, ladder := range []*priceLadder{ob.bids, ob.asks, ob.buyStops, ob.sellStops} {
+		writeLadder(sw, ladder)
+	}
+	return sw.Close()
+}
+
+// ReadSnapshot restores an orderbook written by WriteSnapshot.
+func ReadSnapshot(r io.Reader, opts ...Option) (*Orderbook, error) {
+	sr := snapshot.NewReader(r, snapshotMagic)
+	if sr.Err() == nil && sr.Version != snapshotVersion {
+		return nil, fmt.Errorf("orderbook snapshot version %d is not supported", sr.Version)
+	}
+
+	ob := NewOrderbook(sr.String(), opts...)
+	ob.seq = sr.Uint64()
+	ob.tradeID = sr.Uint64()
+	ob.lastPrice = sr.Decimal()
+
+	for _, n := range readLadder(sr) {
+		ob.restore(n, ob.bids, ob.orders)
+	}
+	for _, n := range readLadder(sr) {
+		ob.restore(n, ob.asks, ob.orders)
+	}
+	for _, n := range readLadder(sr) {
+		ob.restore(n, ob.buyStops, ob.stops)
+	}
+	for _, n := range readLadder(sr) {
+		ob.restore(n, ob.sellStops, ob.stops)
+	}
+
+	if err := sr.Close(); err != nil {
+		return nil, err
+	}
+	return ob, nil
+}
+
+// Orders returns a copy of every resting and untriggered stop order.
+func (ob *Orderbook) Orders() []types.Order {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	orders := make([]types.Order, 0, len(ob.orders)+len(ob.stops))
+	for _, ladder := range []*priceLadder{ob.bids, ob.asks, ob.buyStops, ob.sellStops} {
+		ladder.each(func(level *priceLevel) bool {
+			for node := level.head; node != nil; node = node.next {
+				orders = append(orders, *node.order)
+			}
+			return true
+		})
+	}
+	return orders
+}
+
+// restore appends a node to the back of its level's queue exactly as it was
+// saved, keeping an iceberg order's current visible slice.
+func (ob *Orderbook) restore(node *orderNode, ladder *priceLadder, index map[uuid.UUID]*orderNode) {
+	price := node.order.Price
+	if ladder == ob.buyStops || ladder == ob.sellStops {
+		price = node.order.StopPrice
+	}
+	level := ladder.get(price)
+	if level == nil {
+		level = newPriceLevel(price)
+		ladder.insert(level)
+	}
+	level.push(node)
+	index[node.order.ID] = node
+}
+
+func writeLadder(sw *snapshot.Writer, ladder *priceLadder) {
+	count := 0
+	ladder.each(func(level *priceLevel) bool {
+		count += level.size
+		return true
+	})
+	sw.Uint32(uint32(count))
+
+	ladder.each(func(level *priceLevel) bool {
+		for node := level.head; node != nil; node = node.next {
+			writeNode(sw, node)
+		}
+		return true
+	})
+}
+
+func readLadder(sr *snapshot.Reader) []*orderNode {
+	count := sr.Uint32()
+	var nodes []*orderNode
+	for i := uint32(0); i < count && sr.Err() == nil; i++ {
+		nodes = append(nodes, readNode(sr))
+	}
+	return nodes
+}
+
+func writeNode(sw *snapshot.Writer, node *orderNode) {
+	o := node.order
+	sw.UUID(o.ID)
+	sw.UUID(o.UserID)
+	sw.String(string(o.Side))
+	sw.String(string(o.Type))
+	sw.Decimal(o.Price)
+	sw.Decimal(o.StopPrice)
+	sw.Decimal(o.Quantity)
+	sw.Decimal(o.Filled)
+	sw.String(string(o.Status))
+	sw.Uint64(o.Seq)
+	sw.String(string(o.TimeInForce))
+	sw.Int64(o.ExpireAt)
+	sw.String(string(o.SelfTradePrevention))
+	sw.Decimal(o.DisplayQuantity)
+	sw.Decimal(o.Visible)
+	sw.Bool(o.PostOnly)
+	sw.Bool(o.PostOnlyReprice)
+
+	sw.Decimal(node.maxSlippage)
+	sw.Decimal(node.quoteQuantity)
+	sw.Decimal(node.funds)
+}
+
+func readNode(sr *snapshot.Reader) *orderNode {
+	o := &types.Order{}
+	o.ID = sr.UUID()
+	o.UserID = sr.UUID()
+	o.Side = types.OrderSide(sr.String())
+	o.Type = types.OrderType(sr.String())
+	o.Price = sr.Decimal()
+	o.StopPrice = sr.Decimal()
+	o.Quantity = sr.Decimal()
+	o.Filled = sr.Decimal()
+	o.Status = types.OrderStatus(sr.String())
+	o.Seq = sr.Uint64()
+	o.TimeInForce = types.TimeInForce(sr.String())
+	o.ExpireAt = sr.Int64()
+	o.SelfTradePrevention = types.SelfTradePrevention(sr.String())
+	o.DisplayQuantity = sr.Decimal()
+	o.Visible = sr.Decimal()
+	o.PostOnly = sr.Bool()
+	o.PostOnlyReprice = sr.Bool()
+
+	return &orderNode{
+		order:         o,
+		maxSlippage:   sr.Decimal(),
+		quoteQuantity: sr.Decimal(),
+		funds:         sr.Decimal(),
+	}
+}
@@ -0,0 +1,98 @@
+package matching
+
+import (
+	"sort"
+
+	"github.com/Utsav7428/ChronoXchange/pkg/types"
+
+	"github.com/shopspring/decimal"
+)
+
+// isStop reports whether orders of this type wait in the trigger book.
+func isStop(orderType types.OrderType) bool {
+	return orderType == types.StopMarket || orderType == types.StopLimit
+}
+
+// isMarket reports whether orders of this type trade at any price and never rest.
+func isMarket(orderType types.OrderType) bool {
+	return orderType == types.Market || orderType == types.StopMarket
+}
+
+// reached reports whether the last trade price has hit a stop price. Buy stops
+// trigger as the price rises to them, sell stops as it falls to them.
+func (ob *Orderbook) reached(side types.OrderSide, stopPrice decimal.Decimal) bool {
+	if ob.lastPrice.IsZero() {
+		return false
+	}
+	if side == types.Buy {
+		return ob.lastPrice.GreaterThanOrEqual(stopPrice)
+	}
+	return ob.lastPrice.LessThanOrEqual(stopPrice)
+}
+
+func (ob *Orderbook) stopSide(side types.OrderSide) *priceLadder {
+	if side == types.Buy {
+		return ob.buyStops
+	}
+	return ob.sellStops
+}
+
+// addStop files an untriggered stop order under its stop price.
+func (ob *Orderbook) addStop(node *orderNode) {
+	ladder := ob.stopSide(node.order.Side)
+	level := ladder.get(node.order.StopPrice)
+	if level == nil {
+		level = newPriceLevel(node.order.StopPrice)
+		ladder.insert(level)
+	}
+	level.push(node)
+	ob.stops[node.order.ID] = node
+}
+
+// removeStop takes a stop order out of the trigger book.
+func (ob *Orderbook) removeStop(node *orderNode) {
+	level := node.level
+	level.unlink(node)
+	delete(ob.stops, node.order.ID)
+
+	if level.empty() {
+		ob.stopSide(node.order.Side).delete(level.price)
+	}
+}
+
+// activateStops moves every stop order the last trade price has reached into
+// matching, and keeps going while the resulting trades trigger more of them.
+// Orders triggered by the same price move are injected in arrival order.
+func (ob *Orderbook) activateStops() []AddResult {
+	var results []AddResult
+	for {
+		triggered := ob.takeTriggered()
+		if len(triggered) == 0 {
+			return results
+		}
+		for _, node := range triggered {
+			node.order.Status = types.StatusNew
+			results = append(results, ob.execute(node))
+		}
+	}
+}
+
+// takeTriggered removes and returns the stop orders reached by the last trade price.
+func (ob *Orderbook) takeTriggered() []*orderNode {
+	var triggered []*orderNode
+	for _, side := range []types.OrderSide{types.Buy, types.Sell} {
+		ladder := ob.stopSide(side)
+		for level := ladder.best(); level != nil && ob.reached(side, level.price); level = ladder.best() {
+			for node := level.head; node != nil; {
+				next := node.next
+				ob.removeStop(node)
+				triggered = append(triggered, node)
+				node = next
+			}
+		}
+	}
+	sort.Slice(triggered, func(i, j int) bool {
+		return triggered[i].order.Seq < triggered[j].order.Seq
+	})
+	return triggered
+}
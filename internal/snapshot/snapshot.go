@@ -0,0 +1,246 @@
+// Package snapshot reads and writes the binary layout used for engine and
+// order book snapshots. Values are written big-endian in a fixed order, after
+// a magic string and format version, and followed by a CRC32 of everything
+// before it so that a damaged snapshot is never loaded.
+//
+// Writer and Reader keep the first error they hit and turn every later call
+// into a no-op, so callers can encode a whole structure and check once.
+package snapshot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// maxLength guards against reading a garbage length as a huge allocation.
+const maxLength = 1 << 30
+
+var (
+	// ErrBadMagic is returned when the data is not the kind of snapshot expected.
+	ErrBadMagic = errors.New("snapshot: unrecognised format")
+	// ErrChecksum is returned when a snapshot's contents do not match its checksum.
+	ErrChecksum = errors.New("snapshot: checksum mismatch")
+)
+
+// Writer encodes a snapshot.
+type Writer struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	err error
+}
+
+// NewWriter starts a snapshot with the given magic string and format version.
+func NewWriter(w io.Writer, magic string, version uint16) *Writer {
+	sw := &Writer{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+	sw.write([]byte(magic))
+	sw.Uint16(version)
+	return sw
+}
+
+func (w *Writer) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	w.crc.Write(p)
+	_, w.err = w.w.Write(p)
+}
+
+// Uint16 writes v.
+func (w *Writer) Uint16(v uint16) {
+	w.write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+// Uint32 writes v.
+func (w *Writer) Uint32(v uint32) {
+	w.write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+// Uint64 writes v.
+func (w *Writer) Uint64(v uint64) {
+	w.write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+// Int64 writes v.
+func (w *Writer) Int64(v int64) {
+	w.Uint64(uint64(v))
+}
+
+// Bool writes v as one byte.
+func (w *Writer) Bool(v bool) {
+	if v {
+		w.write([]byte{1})
+	} else {
+		w.write([]byte{0})
+	}
+}
+
+// Bytes writes p prefixed by its length.
+func (w *Writer) Bytes(p []byte) {
+	w.Uint32(uint32(len(p)))
+	w.write(p)
+}
+
+// String writes s prefixed by its length.
+func (w *Writer) String(s string) {
+	w.Bytes([]byte(s))
+}
+
+// Decimal writes d exactly, as its string form.
+func (w *Writer) Decimal(d decimal.Decimal) {
+	w.String(d.String())
+}
+
+// UUID writes id as 16 bytes.
+func (w *Writer) UUID(id uuid.UUID) {
+	w.write(id[:])
+}
+
+// Close writes the checksum and flushes. It returns the first error hit while writing.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if _, err := w.w.Write(binary.BigEndian.AppendUint32(nil, w.crc.Sum32())); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// Reader decodes a snapshot.
+type Reader struct {
+	r       *bufio.Reader
+	crc     hash.Hash32
+	err     error
+	Version uint16 // Format version the snapshot was written with
+}
+
+// NewReader checks that r starts with the given magic string and reads the
+// format version. The caller decides which versions it understands.
+func NewReader(r io.Reader, magic string) *Reader {
+	sr := &Reader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	if got := sr.read(len(magic)); sr.err == nil && string(got) != magic {
+		sr.err = ErrBadMagic
+	}
+	sr.Version = sr.Uint16()
+	return sr
+}
+
+func (r *Reader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r.r, p); err != nil {
+		r.err = err
+		return nil
+	}
+	r.crc.Write(p)
+	return p
+}
+
+// Uint16 reads a value written by Writer.Uint16.
+func (r *Reader) Uint16() uint16 {
+	if p := r.read(2); p != nil {
+		return binary.BigEndian.Uint16(p)
+	}
+	return 0
+}
+
+// Uint32 reads a value written by Writer.Uint32.
+func (r *Reader) Uint32() uint32 {
+	if p := r.read(4); p != nil {
+		return binary.BigEndian.Uint32(p)
+	}
+	return 0
+}
+
+// Uint64 reads a value written by Writer.Uint64.
+func (r *Reader) Uint64() uint64 {
+	if p := r.read(8); p != nil {
+		return binary.BigEndian.Uint64(p)
+	}
+	return 0
+}
+
+// Int64 reads a value written by Writer.Int64.
+func (r *Reader) Int64() int64 {
+	return int64(r.Uint64())
+}
+
+// Bool reads a value written by Writer.Bool.
+func (r *Reader) Bool() bool {
+	p := r.read(1)
+	return p != nil && p[0] == 1
+}
+
+// Bytes reads a value written by Writer.Bytes.
+func (r *Reader) Bytes() []byte {
+	n := r.Uint32()
+	if n > maxLength {
+		r.Fail(fmt.Errorf("snapshot: length %d is too large", n))
+		return nil
+	}
+	return r.read(int(n))
+}
+
+// String reads a value written by Writer.String.
+func (r *Reader) String() string {
+	return string(r.Bytes())
+}
+
+// Decimal reads a value written by Writer.Decimal.
+func (r *Reader) Decimal() decimal.Decimal {
+	s := r.String()
+	if r.err != nil {
+		return decimal.Zero
+	}
+	d, err := decimal.NewFromString(s)
+	if err != nil {
+		r.Fail(err)
+	}
+	return d
+}
+
+// UUID reads a value written by Writer.UUID.
+func (r *Reader) UUID() uuid.UUID {
+	var id uuid.UUID
+	copy(id[:], r.read(16))
+	return id
+}
+
+// Fail records err unless an earlier error is already recorded.
+func (r *Reader) Fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// Err returns the first error hit while reading.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Close reads the checksum and compares it with what was read.
+// It returns the first error hit while reading.
+func (r *Reader) Close() error {
+	if r.err != nil {
+		return r.err
+	}
+	want := r.crc.Sum32()
+	p := make([]byte, 4)
+	if _, err := io.ReadFull(r.r, p); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(p) != want {
+		return ErrChecksum
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+// Package wal is an append-only log of sequenced records on local disk.
+// The engine writes each command to it before applying the command, so that
+// everything it acknowledged can be rebuilt by replaying the log after a crash.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// headerSize is the length of the header in front of every record:
+// sequence number (8 bytes), payload length (4) and checksum (4).
+const headerSize = 16
+
+// maxRecordSize guards against reading a garbage length as a huge allocation.
+const maxRecordSize = 64 << 20
+
+var (
+	// ErrCorrupt is returned when a complete record fails its checksum.
+	ErrCorrupt = errors.New("wal: corrupt record")
+	// ErrOutOfOrder is returned when a record's sequence number does not increase.
+	ErrOutOfOrder = errors.New("wal: sequence number must increase")
+)
+
+// Log is a write-ahead log file. Records are framed with their sequence number
+// and a CRC32 checksum. A record cut short by a crash mid-write is dropped when
+// the log is opened; any other damage is reported as ErrCorrupt.
+type Log struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	last uint64 // Sequence number of the last record, zero if empty
+}
+
+// Open opens the log at path, creating it if needed, and positions it for appending.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	end, last, err := scan(f, 0, nil)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	// Drop a torn record left by a crash in the middle of an append.
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Log{path: path, f: f, last: last}, nil
+}
+
+// Append writes a record and syncs it to disk before returning.
+func (l *Log) Append(seq uint64, payload []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if seq <= l.last {
+		return fmt.Errorf("%w: %d after %d", ErrOutOfOrder, seq, l.last)
+	}
+
+	if _, err := l.f.Write(frame(seq, payload)); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.last = seq
+	return nil
+}
+
+// Compact drops every record whose sequence number is upTo or less, for when
+// a durable snapshot has made them unnecessary. The records after upTo are
+// copied to a new file that is synced and renamed over the log, so a crash
+// part way through leaves either the old log or the new one.
+func (l *Log) Compact(upTo uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	src, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+
+	w := bufio.NewWriter(dst)
+	dropped := 0
+	_, _, err = scan(src, 0, func(seq uint64, payload []byte) error {
+		if seq <= upTo {
+			dropped++
+			return nil
+		}
+		_, err := w.Write(frame(seq, payload))
+		return err
+	})
+	if err == nil && dropped == 0 {
+		return dst.Close()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = dst.Chmod(0o644)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), l.path)
+	}
+	if err != nil {
+		dst.Close()
+		return err
+	}
+
+	// The new file is already positioned at its end, ready for appends.
+	l.f.Close()
+	l.f = dst
+	return syncDir(filepath.Dir(l.path))
+}
+
+// Replay calls fn with every record whose sequence number is greater than
+// after, in the order they were written. It stops at the first error fn returns.
+func (l *Log) Replay(after uint64, fn func(seq uint64, payload []byte) error) error {
+	return ReplayFile(l.path, after, fn)
+}
+
+// ReplayFile is Replay for a log that is not open, such as a copy taken from
+// another machine. The file is only read: a torn record at its end is skipped,
+// not truncated.
+func ReplayFile(path string, after uint64, fn func(seq uint64, payload []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, _, err = scan(f, after, fn)
+	return err
+}
+
+// LastSeq returns the sequence number of the last record in the log.
+func (l *Log) LastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// scan reads records from the start of r, passing those after the given
+// sequence number to fn if it is not nil. It returns the offset just past
+// the last complete record and that record's sequence number.
+func scan(r io.Reader, after uint64, fn func(seq uint64, payload []byte) error) (int64, uint64, error) {
+	br := bufio.NewReader(r)
+	var end int64
+	var last uint64
+	header := make([]byte, headerSize)
+
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return end, last, nil
+			}
+			return end, last, err
+		}
+		seq := binary.BigEndian.Uint64(header[0:8])
+		size := binary.BigEndian.Uint32(header[8:12])
+		if size > maxRecordSize {
+			return end, last, fmt.Errorf("%w at offset %d", ErrCorrupt, end)
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return end, last, nil
+			}
+			return end, last, err
+		}
+		if checksum(header[0:12], payload) != binary.BigEndian.Uint32(header[12:16]) {
+			return end, last, fmt.Errorf("%w at offset %d", ErrCorrupt, end)
+		}
+		if seq <= last {
+			return end, last, fmt.Errorf("%w: %d after %d at offset %d", ErrOutOfOrder, seq, last, end)
+		}
+
+		if fn != nil && seq > after {
+			if err := fn(seq, payload); err != nil {
+				return end, last, err
+			}
+		}
+		end += int64(headerSize) + int64(size)
+		last = seq
+	}
+}
+
+// frame encodes a record with its header.
+func frame(seq uint64, payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint64(buf[0:8], seq)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(payload)))
+	copy(buf[headerSize:], payload)
+	binary.BigEndian.PutUint32(buf[12:16], checksum(buf[0:12], payload))
+	return buf
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func checksum(header, payload []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write(header)
+	crc.Write(payload)
+	return crc.Sum32()
+}
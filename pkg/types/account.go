@@ -0,0 +1,30 @@
+package types
+
+import (
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// Balance is how much of one asset a user holds. Locked funds back open orders
+// and cannot be used for anything else until the orders fill or are cancelled.
+type Balance struct {
+	Available decimal.Decimal `json:"available"`
+	Locked    decimal.Decimal `json:"locked"`
+}
+
+// OnRampData is the payload sent from the API to the engine to credit a user's balance.
+type OnRampData struct {
+	UserID uuid.UUID       `json:"user_id"`
+	Asset  string          `json:"asset"`
+	Amount decimal.Decimal `json:"amount"`
+}
+
+// GetBalancesData is the payload sent from the API to the engine to read a user's balances.
+type GetBalancesData struct {
+	UserID uuid.UUID `json:"user_id"`
+}
+
+// BalancesResponse is the response for ON_RAMP and GET_BALANCES requests, keyed by asset.
+type BalancesResponse struct {
+	Balances map[string]Balance `json:"balances"`
+}
@@ -6,6 +6,9 @@ import (
 )
 
 // This file defines the messages that are sent to the db-processor queue.
+// Sequence identifies the engine event that produced a message; StreamSeq is
+// one more than that of the message before it on the queue, so a jump in it is
+// a lost message and a repeat is a duplicate.
 
 // GenericMessage is used to unmarshal the message first to find its type.
 type GenericMessage struct {
@@ -13,23 +16,50 @@ type GenericMessage struct {
 }
 
 // DBTradeMessage is the payload for a new trade to be saved.
+// ID is derived from Market and TradeID, so a redelivered trade keeps its ID.
 type DBTradeMessage struct {
 	Type          string    `json:"type"`
+	Sequence      uint64    `json:"sequence"`   // Engine event sequence number
+	StreamSeq     uint64    `json:"stream_seq"` // Position on the db-processor queue
 	ID            uuid.UUID `json:"id"`
+	TradeID       uint64    `json:"trade_id"` // Per-market, counting up from 1
 	IsBuyerMaker  bool      `json:"is_buyer_maker"`
 	Price         string    `json:"price"`
 	Quantity      string    `json:"quantity"`
 	QuoteQuantity string    `json:"quote_quantity"`
 	Timestamp     int64     `json:"timestamp"` // Unix milliseconds
 	Market        string    `json:"market"`
+
+	// The resting and incoming orders that traded, and the incoming order's side.
+	MakerOrderID uuid.UUID `json:"maker_order_id"`
+	TakerOrderID uuid.UUID `json:"taker_order_id"`
+	MakerUserID  uuid.UUID `json:"maker_user_id"`
+	TakerUserID  uuid.UUID `json:"taker_user_id"`
+	TakerSide    OrderSide `json:"taker_side"`
+
+	// Who traded and which assets moved, so the trade can be booked in the ledger.
+	BuyerID    uuid.UUID `json:"buyer_id"`
+	SellerID   uuid.UUID `json:"seller_id"`
+	BaseAsset  string    `json:"base_asset"`
+	QuoteAsset string    `json:"quote_asset"`
+
+	// Fees each side paid, out of what it received.
+	BuyerFee  decimal.Decimal `json:"buyer_fee"`  // In the base asset
+	SellerFee decimal.Decimal `json:"seller_fee"` // In the quote asset
 }
 
 // DBOrderMessage is the payload for an order update to be saved.
 type DBOrderMessage struct {
+	Type        string          `json:"type"`
+	Sequence    uint64          `json:"sequence"`   // Engine event sequence number, later updates have higher ones
+	StreamSeq   uint64          `json:"stream_seq"` // Position on the db-processor queue
 	OrderID     uuid.UUID       `json:"order_id"`
+	UserID      uuid.UUID       `json:"user_id"`
 	ExecutedQty decimal.Decimal `json:"executed_qty"`
 	Market      string          `json:"market"`
 	Price       string          `json:"price"`
 	Quantity    string          `json:"quantity"`
 	Side        OrderSide       `json:"side"`
+	Status      OrderStatus     `json:"status"`
+	TriggeredAt int64           `json:"triggered_at,omitempty"` // Unix milliseconds, ORDER_TRIGGERED only
 }
@@ -14,13 +14,97 @@ const (
 	Sell OrderSide = "sell"
 )
 
+// OrderType defines how an order is priced.
+type OrderType string
+
+const (
+	Limit      OrderType = "limit"       // Trades at its price or better and rests otherwise
+	Market     OrderType = "market"      // Trades at the best available prices and never rests
+	StopLimit  OrderType = "stop_limit"  // Becomes a limit order once the last trade reaches StopPrice
+	StopMarket OrderType = "stop_market" // Becomes a market order once the last trade reaches StopPrice
+)
+
+// TimeInForce defines how long an order stays working.
+type TimeInForce string
+
+const (
+	GTC TimeInForce = "GTC" // Good till cancelled: the remainder rests until filled or cancelled
+	IOC TimeInForce = "IOC" // Immediate or cancel: the remainder is cancelled after matching
+	FOK TimeInForce = "FOK" // Fill or kill: fills completely right away or not at all
+	GTD TimeInForce = "GTD" // Good till date: rests like GTC but expires at ExpireAt
+)
+
+// SelfTradePrevention decides what happens when an order would trade with
+// another order from the same user. The incoming order's mode applies.
+type SelfTradePrevention string
+
+const (
+	CancelNewest       SelfTradePrevention = "CANCEL_NEWEST"        // Cancel the rest of the incoming order
+	CancelOldest       SelfTradePrevention = "CANCEL_OLDEST"        // Cancel the resting order and keep matching
+	CancelBoth         SelfTradePrevention = "CANCEL_BOTH"          // Cancel both orders
+	DecrementAndCancel SelfTradePrevention = "DECREMENT_AND_CANCEL" // Shrink both by the overlap, cancelling whichever reaches zero
+)
+
+// OrderStatus describes where an order is in its lifecycle.
+type OrderStatus string
+
+const (
+	StatusUntriggered     OrderStatus = "untriggered" // Stop order waiting for its stop price
+	StatusNew             OrderStatus = "new"
+	StatusPartiallyFilled OrderStatus = "partially_filled"
+	StatusFilled          OrderStatus = "filled"
+	StatusCancelled       OrderStatus = "cancelled"
+	StatusExpired         OrderStatus = "expired"
+)
+
 // CreateOrderData is the payload sent from the API to the engine to create an order.
 type CreateOrderData struct {
 	UserID   uuid.UUID       `json:"user_id"`
 	Market   string          `json:"market"`
-	Price    decimal.Decimal `json:"price"`
+	Type     OrderType       `json:"order_type"` // Defaults to limit when empty
+	Price    decimal.Decimal `json:"price"`      // Ignored for market orders
 	Quantity decimal.Decimal `json:"quantity"`
 	Side     OrderSide       `json:"side"`
+
+	// StopPrice is the last trade price at which a stop order activates.
+	// Buy stops trigger at or above it, sell stops at or below it.
+	StopPrice decimal.Decimal `json:"stop_price"`
+
+	// TimeInForce defaults to GTC when empty. ExpireAt (Unix milliseconds) is
+	// required for GTD orders and ignored otherwise.
+	TimeInForce TimeInForce `json:"time_in_force"`
+	ExpireAt    int64       `json:"expire_at"`
+
+	// PostOnly orders only ever add liquidity. One that would cross the spread
+	// is rejected, or with PostOnlyReprice moved one tick behind the best opposite price.
+	PostOnly        bool `json:"post_only"`
+	PostOnlyReprice bool `json:"post_only_reprice"`
+
+	// DisplayQuantity makes a limit order an iceberg: only this much is shown
+	// on the book at a time, refilled from the hidden rest as it trades.
+	DisplayQuantity decimal.Decimal `json:"display_quantity"`
+
+	// SelfTradePrevention is empty to allow self-trades.
+	SelfTradePrevention SelfTradePrevention `json:"self_trade_prevention"`
+
+	// QuoteQuantity lets a market order spend (or raise) an amount of the
+	// quote asset instead of trading a fixed base quantity.
+	QuoteQuantity decimal.Decimal `json:"quote_quantity"`
+	// MaxSlippage bounds a market order to this fraction away from the best
+	// opposite price at entry, e.g. 0.01 for 1%. Zero means no bound.
+	MaxSlippage decimal.Decimal `json:"max_slippage"`
+
+	// Funds is set by the engine, never by clients. It caps how much a market
+	// order may spend from its locked balance: quote for buys, base for sells.
+	// Zero means no cap.
+	Funds decimal.Decimal `json:"funds"`
+
+	// FeeLevel is the user's VIP level, set by the API from their 30-day volume.
+	FeeLevel int `json:"fee_level"`
+
+	// OrderID is set by the engine, never by clients, so that replaying a
+	// command gives the order the same ID. A new ID is generated if it is nil.
+	OrderID uuid.UUID `json:"order_id"`
 }
 
 // CancelOrderData is the payload sent from the API to the engine to cancel an order.
@@ -30,6 +114,17 @@ type CancelOrderData struct {
 	Market  string    `json:"market"`
 }
 
+// AmendOrderData is the payload sent from the API to the engine to amend a resting order.
+// A zero Price or Quantity leaves that field unchanged. Quantity is the new total
+// quantity of the order, including anything already filled.
+type AmendOrderData struct {
+	UserID   uuid.UUID       `json:"user_id"`
+	OrderID  uuid.UUID       `json:"order_id"`
+	Market   string          `json:"market"`
+	Price    decimal.Decimal `json:"price"`
+	Quantity decimal.Decimal `json:"quantity"`
+}
+
 // GetDepthData is the payload sent from the API to the engine to get order book depth.
 type GetDepthData struct {
 	Market string `json:"market"`
@@ -40,13 +135,20 @@ type GetDepthData struct {
 type APIResponse struct {
 	Success bool        `json:"success"`
 	Message string      `json:"message,omitempty"`
+	Code    string      `json:"code,omitempty"` // Machine-readable reason for a rejection, when there is one
 	Data    interface{} `json:"data,omitempty"`
+
+	// Sequence is the engine's event sequence number when the response was produced.
+	Sequence uint64 `json:"sequence"`
 }
 
 // CreateOrderResponse is the response for a CREATE_ORDER request.
 type CreateOrderResponse struct {
-	OrderID uuid.UUID `json:"order_id"`
-	Fills   []Fill    `json:"fills"`
+	OrderID      uuid.UUID       `json:"order_id"`
+	Fills        []Fill          `json:"fills"`
+	ExecutedQty  decimal.Decimal `json:"executed_qty"`
+	RemainingQty decimal.Decimal `json:"remaining_qty"`
+	Status       OrderStatus     `json:"status"`
 }
 
 // CancelOrderResponse is the response for a CANCEL_ORDER request.
@@ -55,6 +157,16 @@ type CancelOrderResponse struct {
 	Success bool      `json:"success"`
 }
 
+// AmendOrderResponse is the response for an AMEND_ORDER request. An amend that
+// changes the price can trade immediately, so it reports fills like a new order.
+type AmendOrderResponse struct {
+	OrderID      uuid.UUID       `json:"order_id"`
+	Fills        []Fill          `json:"fills"`
+	ExecutedQty  decimal.Decimal `json:"executed_qty"`
+	RemainingQty decimal.Decimal `json:"remaining_qty"`
+	Status       OrderStatus     `json:"status"`
+}
+
 // GetDepthResponse is the response for a GET_DEPTH request.
 type GetDepthResponse struct {
 	Depth DepthPayload `json:"depth"`
@@ -62,21 +174,73 @@ type GetDepthResponse struct {
 
 // Order represents a single order in the live order book within the matching engine.
 type Order struct {
-	ID       uuid.UUID       `json:"id"`
-	UserID   uuid.UUID       `json:"user_id"`
-	Side     OrderSide       `json:"side"`
-	Price    decimal.Decimal `json:"price"`
-	Quantity decimal.Decimal `json:"quantity"`
-	Filled   decimal.Decimal `json:"filled"`
+	ID        uuid.UUID       `json:"id"`
+	UserID    uuid.UUID       `json:"user_id"`
+	Side      OrderSide       `json:"side"`
+	Type      OrderType       `json:"type"`
+	Price     decimal.Decimal `json:"price"`
+	StopPrice decimal.Decimal `json:"stop_price"` // Stop orders only
+	Quantity  decimal.Decimal `json:"quantity"`
+	Filled    decimal.Decimal `json:"filled"`
+	Status    OrderStatus     `json:"status"`
+	Seq       uint64          `json:"seq"` // Arrival sequence within the book, lower fills first
+
+	TimeInForce         TimeInForce         `json:"time_in_force"`
+	ExpireAt            int64               `json:"expire_at,omitempty"` // Unix milliseconds, GTD orders only
+	SelfTradePrevention SelfTradePrevention `json:"self_trade_prevention,omitempty"`
+
+	// PostOnly orders stay passive when amended to a new price, as when placed.
+	PostOnly        bool `json:"post_only,omitempty"`
+	PostOnlyReprice bool `json:"post_only_reprice,omitempty"`
+
+	// Iceberg orders only expose Visible, at most DisplayQuantity, of what remains.
+	DisplayQuantity decimal.Decimal `json:"display_quantity"`
+	Visible         decimal.Decimal `json:"visible_quantity"`
 }
 
-// Fill represents a single matched trade execution.
+// Remaining returns the quantity of the order that has not been filled yet.
+func (o Order) Remaining() decimal.Decimal {
+	return o.Quantity.Sub(o.Filled)
+}
+
+// Fill represents a single matched trade execution between a resting maker
+// order and the incoming taker order.
 type Fill struct {
-	Qty           decimal.Decimal `json:"qty"`
-	Price         decimal.Decimal `json:"price"`
-	TradeID       int64           `json:"trade_id"`
-	MarketOrderID uuid.UUID       `json:"market_order_id"`
-	OtherUserID   uuid.UUID       `json:"other_user_id"`
+	Qty          decimal.Decimal `json:"qty"`
+	Price        decimal.Decimal `json:"price"`
+	TradeID      uint64          `json:"trade_id"`  // Counts up from 1 in each market with no gaps
+	Timestamp    int64           `json:"timestamp"` // Unix milliseconds
+	MakerOrderID uuid.UUID       `json:"maker_order_id"`
+	MakerUserID  uuid.UUID       `json:"maker_user_id"`
+	TakerOrderID uuid.UUID       `json:"taker_order_id"`
+	TakerUserID  uuid.UUID       `json:"taker_user_id"`
+	TakerSide    OrderSide       `json:"taker_side"` // The aggressor's side
+
+	// Fees are charged by the engine in the asset each side receives:
+	// base for the buyer, quote for the seller.
+	TakerFee decimal.Decimal `json:"taker_fee"`
+	MakerFee decimal.Decimal `json:"maker_fee"`
+}
+
+// IsBuyerMaker reports whether the buyer was the resting order.
+func (f Fill) IsBuyerMaker() bool {
+	return f.TakerSide == Sell
+}
+
+// Buyer returns the user who bought.
+func (f Fill) Buyer() uuid.UUID {
+	if f.TakerSide == Buy {
+		return f.TakerUserID
+	}
+	return f.MakerUserID
+}
+
+// Seller returns the user who sold.
+func (f Fill) Seller() uuid.UUID {
+	if f.TakerSide == Sell {
+		return f.TakerUserID
+	}
+	return f.MakerUserID
 }
 
 // DepthPayload represents the state of the order book for a given market.
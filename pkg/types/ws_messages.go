@@ -1,18 +1,36 @@
 package types
 
-import "github.com/shopspring/decimal"
+import (
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
 
 // WsMessage is the standard wrapper for all messages sent to clients.
 type WsMessage struct {
-	Stream string      `json:"stream"` // e.g., "trades@SOL_USDC"
-	Data   interface{} `json:"data"`
+	Stream    string      `json:"stream"`     // e.g., "trades@SOL_USDC"
+	Sequence  uint64      `json:"sequence"`   // Engine event sequence number that produced the message
+	StreamSeq uint64      `json:"stream_seq"` // One more than the previous message on Stream; check this for gaps
+	Data      interface{} `json:"data"`
 }
 
 // TradeData is the payload for a trade update.
 type TradeData struct {
-	EventType string          `json:"e"` // "trade"
-	TradeID   int64           `json:"t"`
-	Price     decimal.Decimal `json:"p"`
-	Quantity  decimal.Decimal `json:"q"`
+	EventType    string          `json:"e"` // "trade"
+	TradeID      uint64          `json:"t"`
+	Price        decimal.Decimal `json:"p"`
+	Quantity     decimal.Decimal `json:"q"`
+	IsBuyerMaker bool            `json:"m"`
+	Market       string          `json:"s"`
+	Timestamp    int64           `json:"T"` // Unix milliseconds
+}
+
+// TriggerData is the payload sent when a stop order's stop price is reached.
+type TriggerData struct {
+	EventType string          `json:"e"` // "triggered"
+	OrderID   uuid.UUID       `json:"i"`
+	Side      OrderSide       `json:"S"`
+	OrderType OrderType       `json:"o"`
+	StopPrice decimal.Decimal `json:"sp"`
 	Market    string          `json:"s"`
+	Timestamp int64           `json:"T"` // Unix milliseconds
 }